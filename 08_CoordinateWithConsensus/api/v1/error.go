@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -35,3 +36,194 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ストアのフレームのチェックサムが一致しない、もしくはフレームが途中で途切れていることを示す。
+// BaseOffsetはレコードを含むセグメントのベースオフセット、Posはストアファイル内の位置。
+type ErrCorruptRecord struct {
+	BaseOffset uint64
+	Pos        uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record: segment %d, position %d", e.BaseOffset, e.Pos),
+		fmt.Sprintf(
+			"The record stored at position %d of segment %d failed its checksum",
+			e.Pos,
+			e.BaseOffset,
+		),
+	)
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownGroup struct {
+	Group string
+}
+
+func (e ErrUnknownGroup) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.NotFound,
+		fmt.Sprintf("unknown consumer group: %s", e.Group),
+		fmt.Sprintf("The consumer group has not committed any offset: %s", e.Group),
+	)
+}
+
+func (e ErrUnknownGroup) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownTopic struct {
+	Topic string
+}
+
+func (e ErrUnknownTopic) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.NotFound,
+		fmt.Sprintf("unknown topic: %s", e.Topic),
+		fmt.Sprintf("The requested topic does not exist: %s", e.Topic),
+	)
+}
+
+func (e ErrUnknownTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownPartition struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrUnknownPartition) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.NotFound,
+		fmt.Sprintf("unknown partition: %s/%d", e.Topic, e.Partition),
+		fmt.Sprintf(
+			"The requested partition does not exist: %s/%d",
+			e.Topic, e.Partition,
+		),
+	)
+}
+
+func (e ErrUnknownPartition) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic already exists: %s", e.Topic),
+		fmt.Sprintf("The topic already exists: %s", e.Topic),
+	)
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopicName struct {
+	Topic string
+}
+
+func (e ErrInvalidTopicName) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic name: %q", e.Topic),
+		fmt.Sprintf(
+			"Topic names must consist of letters, digits, '.', '_' and '-': %q",
+			e.Topic,
+		),
+	)
+}
+
+func (e ErrInvalidTopicName) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// コンシューマグループ名が空の場合に返す
+type ErrInvalidGroupName struct {
+	Group string
+}
+
+func (e ErrInvalidGroupName) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid group name: %q", e.Group),
+		fmt.Sprintf(
+			"Consumer group names must not be empty: %q",
+			e.Group,
+		),
+	)
+}
+
+func (e ErrInvalidGroupName) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// リーダーでないサーバが読み出しを受け取った場合に返す。Leaderはリーダーのアドレスで、リーダーがいない場合は空になる
+type ErrNotLeader struct {
+	Leader string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := localizedStatus(
+		codes.FailedPrecondition,
+		fmt.Sprintf("not the leader, leader: %q", e.Leader),
+		fmt.Sprintf(
+			"This server is not the leader. Retry the request at the leader: %q",
+			e.Leader,
+		),
+	)
+	// クライアントがリーダーにリダイレクトできるようにアドレスを詳細に含める
+	std, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "NOT_LEADER",
+		Domain:   "proglog",
+		Metadata: map[string]string{"leader": e.Leader},
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// raftのクラスタに参加していないサーバを指定された場合に返す
+type ErrUnknownServer struct {
+	ID string
+}
+
+func (e ErrUnknownServer) GRPCStatus() *status.Status {
+	return localizedStatus(
+		codes.NotFound,
+		fmt.Sprintf("unknown server: %s", e.ID),
+		fmt.Sprintf("The server is not a member of the cluster: %s", e.ID),
+	)
+}
+
+func (e ErrUnknownServer) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ステータスに英語の説明を詳細として付与する
+func localizedStatus(c codes.Code, msg, localized string) *status.Status {
+	st := status.New(c, msg)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: localized,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/lottotto/proglog/internal/agent"
+	"github.com/lottotto/proglog/internal/config"
+	plog "github.com/lottotto/proglog/internal/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// エージェントを起動するコマンド。設定はフラグ、環境変数、設定ファイルの順に優先される
+type cli struct {
+	v   *viper.Viper
+	cfg cfg
+}
+
+type cfg struct {
+	agent.Config
+	ServerTLSConfig config.TLSConfig
+	PeerTLSConfig   config.TLSConfig
+	// trueの場合は停止する時にクラスタから恒久的に離脱する。falseの場合は再起動に備えてraftの構成に残る
+	LeaveOnShutdown bool
+}
+
+func main() {
+	cmd := newCommand()
+	if err := cmd.Execute(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newCommand() *cobra.Command {
+	cli := &cli{v: viper.New()}
+	cmd := &cobra.Command{
+		Use:     "proglog",
+		PreRunE: cli.setupConfig,
+		RunE:    cli.run,
+	}
+	if err := cli.setupFlags(cmd); err != nil {
+		log.Fatal(err)
+	}
+	return cmd
+}
+
+func (c *cli) setupFlags(cmd *cobra.Command) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	cmd.Flags().String("config-file", "", "Path to config file (YAML or TOML).")
+
+	dataDir := path.Join(os.TempDir(), "proglog")
+	cmd.Flags().String("data-dir", dataDir, "Directory to store log and Raft data.")
+	cmd.Flags().String("node-name", hostname, "Unique server ID.")
+
+	cmd.Flags().String("bind-addr", "127.0.0.1:8401", "Address to bind Serf on.")
+	cmd.Flags().Int("rpc-port", 8400, "Port for RPC clients (and Raft) connections.")
+	cmd.Flags().StringSlice("start-join-addrs", nil, "Serf addresses to join.")
+	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Bool("read-replica", false, "Join the cluster as a non-voting read replica.")
+	cmd.Flags().Bool("leave-on-shutdown", false, "Leave the cluster permanently on shutdown instead of keeping Raft membership for a restart.")
+	cmd.Flags().Duration("shutdown-timeout", 0, "How long to drain in-flight RPCs such as consume streams on shutdown.")
+
+	// 0の場合はraftとlog.Configのデフォルト値を使う
+	cmd.Flags().Duration("raft-heartbeat-timeout", 0, "Raft heartbeat timeout.")
+	cmd.Flags().Duration("raft-election-timeout", 0, "Raft election timeout.")
+	cmd.Flags().Duration("raft-leader-lease-timeout", 0, "Raft leader lease timeout.")
+	cmd.Flags().Duration("raft-commit-timeout", 0, "Raft commit timeout.")
+	cmd.Flags().Uint64("raft-snapshot-threshold", 0, "Number of Raft log entries since the last snapshot that triggers a snapshot.")
+	cmd.Flags().Duration("raft-snapshot-interval", 0, "How often Raft checks whether to take a snapshot.")
+	cmd.Flags().Uint64("raft-trailing-logs", 0, "Number of Raft log entries kept after a snapshot.")
+	cmd.Flags().Int("raft-snapshot-retain", 0, "Number of Raft snapshots kept on disk.")
+	cmd.Flags().Int("raft-max-pool", 0, "Number of Raft transport connections pooled per peer.")
+	cmd.Flags().Duration("raft-transport-timeout", 0, "Raft transport I/O timeout.")
+	cmd.Flags().Duration("raft-apply-timeout", 0, "Timeout for applying an entry through Raft.")
+	cmd.Flags().Duration("raft-read-timeout", 0, "Timeout for linearizable reads to wait for committed entries.")
+
+	// 0の場合はlog.Configのデフォルト値を使う
+	cmd.Flags().Uint64("segment-max-store-bytes", 0, "Maximum size of a segment store file.")
+	cmd.Flags().Uint64("segment-max-index-bytes", 0, "Maximum size of a segment index file.")
+	cmd.Flags().String("segment-sync", "", "When appends are fsynced: os, group or always. Also applies to the Raft log, which defaults to always.")
+	cmd.Flags().Duration("segment-sync-interval", 0, "How often the group sync policy fsyncs.")
+	cmd.Flags().Uint64("segment-sync-bytes", 0, "Number of appended bytes that triggers a group sync.")
+	cmd.Flags().Uint64("segment-max-open-segments", 0, "Number of sealed segments kept open.")
+	cmd.Flags().Uint64("segment-index-interval-records", 0, "Index one record every N records. 0 indexes every record.")
+	cmd.Flags().Uint64("segment-index-interval-bytes", 0, "Index one record every N store bytes.")
+	cmd.Flags().Uint64("retention-max-bytes", 0, "Maximum total size of the log before old segments are deleted. 0 disables.")
+	cmd.Flags().Duration("retention-max-age", 0, "How long segments are kept after their last write. 0 disables.")
+	cmd.Flags().Uint64("retention-min-offset", 0, "Delete segments holding only records below this offset. 0 disables.")
+	cmd.Flags().Duration("retention-check-interval", 0, "How often retention is checked.")
+
+	cmd.Flags().String("acl-model-file", "", "Path to ACL model.")
+	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy.")
+
+	cmd.Flags().String("server-tls-cert-file", "", "Path to server tls cert.")
+	cmd.Flags().String("server-tls-key-file", "", "Path to server tls key.")
+	cmd.Flags().String("server-tls-ca-file", "", "Path to server certificate authority.")
+
+	cmd.Flags().String("peer-tls-cert-file", "", "Path to peer tls cert.")
+	cmd.Flags().String("peer-tls-key-file", "", "Path to peer tls key.")
+	cmd.Flags().String("peer-tls-ca-file", "", "Path to peer certificate authority.")
+
+	// フラグ名のハイフンをアンダースコアに置き換えた環境変数を読む。例: PROGLOG_DATA_DIR
+	c.v.SetEnvPrefix("proglog")
+	c.v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	c.v.AutomaticEnv()
+	return c.v.BindPFlags(cmd.Flags())
+}
+
+func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
+	var err error
+	v := c.v
+	// 設定ファイルのキーはフラグ名と同じ。形式は拡張子から判断する
+	if configFile := v.GetString("config-file"); configFile != "" {
+		v.SetConfigFile(configFile)
+		if err = v.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	c.cfg.DataDir = v.GetString("data-dir")
+	c.cfg.NodeName = v.GetString("node-name")
+	c.cfg.BindAddr = v.GetString("bind-addr")
+	c.cfg.RPCPort = v.GetInt("rpc-port")
+	c.cfg.StartJoinAddrs = v.GetStringSlice("start-join-addrs")
+	c.cfg.Bootstrap = v.GetBool("bootstrap")
+	c.cfg.ReadReplica = v.GetBool("read-replica")
+	c.cfg.LeaveOnShutdown = v.GetBool("leave-on-shutdown")
+	c.cfg.ShutdownTimeout = v.GetDuration("shutdown-timeout")
+	c.cfg.Raft.HeartbeatTimeout = v.GetDuration("raft-heartbeat-timeout")
+	c.cfg.Raft.ElectionTimeout = v.GetDuration("raft-election-timeout")
+	c.cfg.Raft.LeaderLeaseTimeout = v.GetDuration("raft-leader-lease-timeout")
+	c.cfg.Raft.CommitTimeout = v.GetDuration("raft-commit-timeout")
+	c.cfg.Raft.SnapshotThreshold = v.GetUint64("raft-snapshot-threshold")
+	c.cfg.Raft.SnapshotInterval = v.GetDuration("raft-snapshot-interval")
+	c.cfg.Raft.TrailingLogs = v.GetUint64("raft-trailing-logs")
+	c.cfg.Raft.SnapshotRetain = v.GetInt("raft-snapshot-retain")
+	c.cfg.Raft.MaxPool = v.GetInt("raft-max-pool")
+	c.cfg.Raft.TransportTimeout = v.GetDuration("raft-transport-timeout")
+	c.cfg.Raft.ApplyTimeout = v.GetDuration("raft-apply-timeout")
+	c.cfg.Raft.ReadTimeout = v.GetDuration("raft-read-timeout")
+	c.cfg.Segment.MaxStoreBytes = v.GetUint64("segment-max-store-bytes")
+	c.cfg.Segment.MaxIndexBytes = v.GetUint64("segment-max-index-bytes")
+	if c.cfg.Segment.Sync, err = plog.ParseSyncPolicy(v.GetString("segment-sync")); err != nil {
+		return err
+	}
+	c.cfg.Segment.SyncInterval = v.GetDuration("segment-sync-interval")
+	c.cfg.Segment.SyncBytes = v.GetUint64("segment-sync-bytes")
+	c.cfg.Segment.MaxOpenSegments = v.GetUint64("segment-max-open-segments")
+	c.cfg.Segment.IndexIntervalRecords = v.GetUint64("segment-index-interval-records")
+	c.cfg.Segment.IndexIntervalBytes = v.GetUint64("segment-index-interval-bytes")
+	c.cfg.Retention.MaxBytes = v.GetUint64("retention-max-bytes")
+	c.cfg.Retention.MaxAge = v.GetDuration("retention-max-age")
+	c.cfg.Retention.MinOffset = v.GetUint64("retention-min-offset")
+	c.cfg.Retention.CheckInterval = v.GetDuration("retention-check-interval")
+	c.cfg.ACLModelFile = v.GetString("acl-model-file")
+	c.cfg.ACLPolicyFile = v.GetString("acl-policy-file")
+	c.cfg.ServerTLSConfig.CertFile = v.GetString("server-tls-cert-file")
+	c.cfg.ServerTLSConfig.KeyFile = v.GetString("server-tls-key-file")
+	c.cfg.ServerTLSConfig.CAFile = v.GetString("server-tls-ca-file")
+	c.cfg.PeerTLSConfig.CertFile = v.GetString("peer-tls-cert-file")
+	c.cfg.PeerTLSConfig.KeyFile = v.GetString("peer-tls-key-file")
+	c.cfg.PeerTLSConfig.CAFile = v.GetString("peer-tls-ca-file")
+
+	if c.cfg.ServerTLSConfig.CertFile != "" &&
+		c.cfg.ServerTLSConfig.KeyFile != "" {
+		c.cfg.ServerTLSConfig.Server = true
+		c.cfg.Config.ServerTLSConfig, err = config.SetupTLSConfig(
+			c.cfg.ServerTLSConfig,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.PeerTLSConfig.CertFile != "" &&
+		c.cfg.PeerTLSConfig.KeyFile != "" {
+		c.cfg.Config.PeerTLSConfig, err = config.SetupTLSConfig(
+			c.cfg.PeerTLSConfig,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// エージェントを起動し、SIGINTかSIGTERMを受け取ったら停止する。--leave-on-shutdownの場合はクラスタから離脱する
+func (c *cli) run(cmd *cobra.Command, args []string) error {
+	agent, err := agent.New(c.cfg.Config)
+	if err != nil {
+		return err
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+	if c.cfg.LeaveOnShutdown {
+		return agent.Leave()
+	}
+	return agent.Shutdown()
+}
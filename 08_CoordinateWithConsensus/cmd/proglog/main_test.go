@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	plog "github.com/lottotto/proglog/internal/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "proglog-cmd-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+data-dir: /var/lib/proglog
+node-name: from-file
+rpc-port: 9000
+start-join-addrs:
+  - 127.0.0.1:9001
+  - 127.0.0.1:9002
+bootstrap: true
+raft-snapshot-threshold: 1024
+raft-snapshot-interval: 30s
+raft-snapshot-retain: 3
+segment-sync: group
+retention-max-age: 168h
+`), 0600))
+
+	// 環境変数は設定ファイルより、フラグは環境変数より優先される
+	t.Setenv("PROGLOG_NODE_NAME", "from-env")
+	t.Setenv("PROGLOG_RPC_PORT", "9100")
+	t.Setenv("PROGLOG_RAFT_APPLY_TIMEOUT", "5s")
+	t.Setenv("PROGLOG_RETENTION_MAX_BYTES", "1048576")
+	c := &cli{v: viper.New()}
+	cmd := &cobra.Command{}
+	require.NoError(t, c.setupFlags(cmd))
+	require.NoError(t, cmd.Flags().Parse([]string{
+		"--config-file", configFile,
+		"--rpc-port", "9200",
+		"--raft-max-pool", "8",
+		"--read-replica",
+		"--leave-on-shutdown",
+		"--shutdown-timeout", "3s",
+		"--segment-max-store-bytes", "4096",
+		"--segment-index-interval-records", "16",
+	}))
+	require.NoError(t, c.setupConfig(cmd, nil))
+
+	require.Equal(t, "/var/lib/proglog", c.cfg.DataDir)
+	require.Equal(t, "from-env", c.cfg.NodeName)
+	require.Equal(t, 9200, c.cfg.RPCPort)
+	require.Equal(t, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, c.cfg.StartJoinAddrs)
+	require.True(t, c.cfg.Bootstrap)
+	require.True(t, c.cfg.ReadReplica)
+	require.True(t, c.cfg.LeaveOnShutdown)
+	require.Equal(t, 3*time.Second, c.cfg.ShutdownTimeout)
+	require.Equal(t, uint64(1024), c.cfg.Raft.SnapshotThreshold)
+	require.Equal(t, 30*time.Second, c.cfg.Raft.SnapshotInterval)
+	require.Equal(t, 3, c.cfg.Raft.SnapshotRetain)
+	require.Equal(t, 5*time.Second, c.cfg.Raft.ApplyTimeout)
+	require.Equal(t, 8, c.cfg.Raft.MaxPool)
+	require.Equal(t, plog.SyncGroup, c.cfg.Segment.Sync)
+	require.Equal(t, uint64(4096), c.cfg.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(16), c.cfg.Segment.IndexIntervalRecords)
+	require.Equal(t, 168*time.Hour, c.cfg.Retention.MaxAge)
+	require.Equal(t, uint64(1048576), c.cfg.Retention.MaxBytes)
+	// 指定されていない値はフラグのデフォルト値になる
+	require.Equal(t, "127.0.0.1:8401", c.cfg.BindAddr)
+	require.Nil(t, c.cfg.Config.ServerTLSConfig)
+	require.Zero(t, c.cfg.Raft.TrailingLogs)
+	require.Zero(t, c.cfg.Retention.MinOffset)
+
+	// 不明な同期ポリシーはエラーになる
+	require.NoError(t, cmd.Flags().Set("segment-sync", "never"))
+	require.Error(t, c.setupConfig(cmd, nil))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 標準入力かファイルの1行を1つのレコードとして書き込む
+func (c *ctl) produceCommand() *cobra.Command {
+	var (
+		topic     string
+		partition uint32
+		key       string
+		headers   map[string]string
+	)
+	cmd := &cobra.Command{
+		Use:   "produce [file]",
+		Short: "Produce each line of a file or stdin as a record.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in := c.in
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			var h map[string][]byte
+			if len(headers) > 0 {
+				h = make(map[string][]byte, len(headers))
+				for k, v := range headers {
+					h[k] = []byte(v)
+				}
+			}
+			scanner := bufio.NewScanner(in)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				res, err := c.client.Produce(cmd.Context(), &api.ProduceRequest{
+					Record: &api.Record{
+						Value:   append([]byte(nil), scanner.Bytes()...),
+						Key:     []byte(key),
+						Headers: h,
+					},
+					Topic:     topic,
+					Partition: partition,
+				})
+				if err != nil {
+					return err
+				}
+				if err := c.print(res, fmt.Sprintf(
+					"partition=%d offset=%d", res.Partition, res.Offset,
+				)); err != nil {
+					return err
+				}
+			}
+			return scanner.Err()
+		},
+	}
+	cmd.Flags().StringVar(&topic, "topic", "", "Topic to produce to. Defaults to the default topic.")
+	cmd.Flags().Uint32Var(&partition, "partition", 0, "Partition for records without a key.")
+	cmd.Flags().StringVar(&key, "key", "", "Key of the records. Routes all records to the key's partition.")
+	cmd.Flags().StringToStringVar(&headers, "header", nil, "Headers of the records as name=value pairs, e.g. trace-id=abc,content-type=text/plain.")
+	return cmd
+}
+
+// offsetからログの末尾まで読み出す。followの場合は新しいレコードを待ち続ける
+func (c *ctl) consumeCommand() *cobra.Command {
+	var (
+		topic     string
+		partition uint32
+		offset    uint64
+		group     string
+		follow    bool
+		startTime string
+	)
+	cmd := &cobra.Command{
+		Use:   "consume",
+		Short: "Consume records from an offset, or tail the log with --follow.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req := &api.ConsumeRequest{
+				Topic:     topic,
+				Partition: partition,
+				Offset:    offset,
+				Group:     group,
+			}
+			if startTime != "" {
+				t, err := time.Parse(time.RFC3339Nano, startTime)
+				if err != nil {
+					return fmt.Errorf("invalid start time: %w", err)
+				}
+				req.StartTime = t.UnixNano()
+			}
+			if follow {
+				stream, err := c.client.ConsumeStream(cmd.Context(), req)
+				if err != nil {
+					return err
+				}
+				for {
+					res, err := stream.Recv()
+					if err == io.EOF || status.Code(err) == codes.Canceled {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+					if err := c.printRecord(res.Record); err != nil {
+						return err
+					}
+				}
+			}
+			for {
+				res, err := c.client.Consume(cmd.Context(), req)
+				if status.Code(err) == status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := c.printRecord(res.Record); err != nil {
+					return err
+				}
+				// 開始時刻は最初のレコードを見つけるためだけに使う
+				req.Offset = res.Record.Offset + 1
+				req.StartTime = 0
+			}
+		},
+	}
+	cmd.Flags().StringVar(&topic, "topic", "", "Topic to consume from. Defaults to the default topic.")
+	cmd.Flags().Uint32Var(&partition, "partition", 0, "Partition to consume from.")
+	cmd.Flags().Uint64Var(&offset, "offset", 0, "Offset to start from.")
+	cmd.Flags().StringVar(&group, "group", "", "Consumer group to resume from when following.")
+	cmd.Flags().StringVar(&startTime, "start-time", "", "Start from the first record appended at or after this RFC 3339 time instead of --offset.")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Wait for new records at the end of the log.")
+	return cmd
+}
+
+func (c *ctl) printRecord(record *api.Record) error {
+	text := fmt.Sprintf("%d\t%s", record.Offset, record.Value)
+	if len(record.Key) > 0 {
+		text = fmt.Sprintf("%d\t%s\t%s", record.Offset, record.Key, record.Value)
+	}
+	return c.print(record, text)
+}
+
+func (c *ctl) serversCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "servers",
+		Short: "Show the servers in the cluster and which one is the leader.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.client.GetServers(cmd.Context(), &api.GetServersRequest{})
+			if err != nil {
+				return err
+			}
+			var b strings.Builder
+			w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tRPC ADDRESS\tLEADER\tVOTER")
+			for _, server := range res.Servers {
+				fmt.Fprintf(w, "%s\t%s\t%t\t%t\n",
+					server.Id, server.RpcAddr, server.IsLeader, server.IsVoter,
+				)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			return c.print(res, strings.TrimSuffix(b.String(), "\n"))
+		},
+	}
+}
+
+func (c *ctl) joinCommand() *cobra.Command {
+	var nonVoter bool
+	cmd := &cobra.Command{
+		Use:   "join ID RPC_ADDR",
+		Short: "Add a server to the Raft cluster as a voter or a read replica.",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.client.Join(cmd.Context(), &api.JoinRequest{
+				Id:       args[0],
+				RpcAddr:  args[1],
+				NonVoter: nonVoter,
+			})
+			if err != nil {
+				return err
+			}
+			return c.print(res, fmt.Sprintf("joined %s", args[0]))
+		},
+	}
+	cmd.Flags().BoolVar(&nonVoter, "non-voter", false, "Add the server as a read replica that does not vote.")
+	return cmd
+}
+
+// 読み出し専用のレプリカを投票者に昇格する
+func (c *ctl) promoteCommand() *cobra.Command {
+	return c.setVoterCommand("promote", "Promote a read replica to a voter.", true)
+}
+
+// 投票者を読み出し専用のレプリカに降格する
+func (c *ctl) demoteCommand() *cobra.Command {
+	return c.setVoterCommand("demote", "Demote a voter to a read replica.", false)
+}
+
+func (c *ctl) setVoterCommand(name, short string, voter bool) *cobra.Command {
+	return &cobra.Command{
+		Use:   name + " ID",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.client.SetVoter(cmd.Context(), &api.SetVoterRequest{
+				Id:    args[0],
+				Voter: voter,
+			})
+			if err != nil {
+				return err
+			}
+			return c.print(res, fmt.Sprintf("%sd %s", name, args[0]))
+		},
+	}
+}
+
+func (c *ctl) leaveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "leave ID",
+		Short: "Remove a server from the Raft cluster.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.client.Leave(cmd.Context(), &api.LeaveRequest{Id: args[0]})
+			if err != nil {
+				return err
+			}
+			return c.print(res, fmt.Sprintf("removed %s", args[0]))
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/lottotto/proglog/internal/config"
+	_ "github.com/lottotto/proglog/internal/loadbalance"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// クラスタを操作する運用者向けのコマンド
+type ctl struct {
+	addr     string
+	caFile   string
+	certFile string
+	keyFile  string
+	output   string
+
+	conn   *grpc.ClientConn
+	client api.LogClient
+	in     io.Reader
+	out    io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	c := &ctl{in: os.Stdin, out: os.Stdout}
+	if err := c.command().ExecuteContext(ctx); err != nil {
+		stop()
+		log.Fatal(err)
+	}
+}
+
+func (c *ctl) command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:               "proglogctl",
+		Short:             "Produce, consume and inspect a proglog cluster.",
+		SilenceUsage:      true,
+		PersistentPreRunE: c.connect,
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			if c.conn == nil {
+				return nil
+			}
+			return c.conn.Close()
+		},
+	}
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&c.addr, "addr", "127.0.0.1:8400", "RPC address of a server. Prefix with proglog:/// to balance across the cluster.")
+	flags.StringVar(&c.caFile, "ca-file", "", "Path to certificate authority.")
+	flags.StringVar(&c.certFile, "cert-file", "", "Path to client tls cert.")
+	flags.StringVar(&c.keyFile, "key-file", "", "Path to client tls key.")
+	flags.StringVarP(&c.output, "output", "o", "text", "Output format: text or json.")
+
+	cmd.AddCommand(
+		c.produceCommand(),
+		c.consumeCommand(),
+		c.serversCommand(),
+		c.joinCommand(),
+		c.leaveCommand(),
+		c.promoteCommand(),
+		c.demoteCommand(),
+	)
+	return cmd
+}
+
+// サーバに接続する。証明書が指定されていない場合はTLSを使わない
+func (c *ctl) connect(cmd *cobra.Command, args []string) error {
+	if c.output != "text" && c.output != "json" {
+		return fmt.Errorf("unknown output format: %s", c.output)
+	}
+	// テストではクライアントを差し替える
+	if c.client != nil {
+		return nil
+	}
+	creds := insecure.NewCredentials()
+	if c.caFile != "" || c.certFile != "" {
+		host, _, err := net.SplitHostPort(strings.TrimPrefix(c.addr, "proglog:///"))
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      c.certFile,
+			KeyFile:       c.keyFile,
+			CAFile:        c.caFile,
+			ServerAddress: host,
+		})
+		if err != nil {
+			return err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	var err error
+	c.conn, err = grpc.Dial(c.addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	c.client = api.NewLogClient(c.conn)
+	return nil
+}
+
+// jsonの場合はメッセージを1行のJSONとして、textの場合はtextで整形した文字列を出力する
+func (c *ctl) print(m proto.Message, text string) error {
+	if c.output == "json" {
+		b, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.out, string(b))
+		return err
+	}
+	_, err := fmt.Fprintln(c.out, text)
+	return err
+}
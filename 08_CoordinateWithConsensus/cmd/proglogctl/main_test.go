@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProduceConsume(t *testing.T) {
+	client := &logClient{}
+	out := run(t, client, "one\ntwo\n", "produce", "--topic", "orders")
+	require.Equal(t, "partition=0 offset=0\npartition=0 offset=1\n", out)
+	require.Equal(t, "orders", client.topic)
+
+	out = run(t, client, "", "consume", "--offset", "1")
+	require.Equal(t, "1\ttwo\n", out)
+
+	out = run(t, client, "", "consume", "-o", "json")
+	require.Equal(t,
+		`{"value":"b25l","offset":"0","term":"0","type":0,"key":"","timestamp":"0","headers":{},"raft_index":"0"}`+"\n"+
+			`{"value":"dHdv","offset":"1","term":"0","type":0,"key":"","timestamp":"0","headers":{},"raft_index":"0"}`+"\n",
+		strings.ReplaceAll(out, " ", ""),
+	)
+}
+
+func TestProduceHeaders(t *testing.T) {
+	client := &logClient{}
+	run(t, client, "one\n", "produce", "--key", "user-1", "--header", "trace-id=abc,content-type=text/plain")
+	require.Equal(t, []byte("user-1"), client.records[0].Key)
+	require.Equal(t, map[string][]byte{
+		"trace-id":     []byte("abc"),
+		"content-type": []byte("text/plain"),
+	}, client.records[0].Headers)
+
+	out := run(t, client, "", "consume", "-o", "json")
+	require.Contains(t, strings.ReplaceAll(out, " ", ""), `"headers":{"content-type":"dGV4dC9wbGFpbg==","trace-id":"YWJj"}`)
+}
+
+func TestConsumeStartTime(t *testing.T) {
+	start := time.Date(2022, 10, 1, 10, 0, 0, 0, time.UTC)
+	client := &logClient{records: []*api.Record{
+		{Value: []byte("before"), Offset: 0, Timestamp: start.Add(-time.Minute).UnixNano()},
+		{Value: []byte("at"), Offset: 1, Timestamp: start.UnixNano()},
+		{Value: []byte("after"), Offset: 2, Timestamp: start.Add(time.Minute).UnixNano()},
+	}}
+	out := run(t, client, "", "consume", "--start-time", "2022-10-01T10:00:00Z")
+	require.Equal(t, "1\tat\n2\tafter\n", out)
+}
+
+func TestServers(t *testing.T) {
+	client := &logClient{servers: []*api.Server{
+		{Id: "0", RpcAddr: "127.0.0.1:8400", IsLeader: true, IsVoter: true},
+		{Id: "1", RpcAddr: "127.0.0.1:8401", IsVoter: true},
+	}}
+	out := run(t, client, "", "servers")
+	require.Equal(t, ""+
+		"ID  RPC ADDRESS     LEADER  VOTER\n"+
+		"0   127.0.0.1:8400  true    true\n"+
+		"1   127.0.0.1:8401  false   true\n",
+		out,
+	)
+}
+
+func TestJoinNonVoterAndPromote(t *testing.T) {
+	client := &logClient{}
+	out := run(t, client, "", "join", "2", "127.0.0.1:8402", "--non-voter")
+	require.Equal(t, "joined 2\n", out)
+	require.True(t, proto.Equal(&api.Server{Id: "2", RpcAddr: "127.0.0.1:8402"}, client.servers[0]))
+
+	out = run(t, client, "", "promote", "2")
+	require.Equal(t, "promoted 2\n", out)
+	require.True(t, client.servers[0].IsVoter)
+	out = run(t, client, "", "demote", "2", "-o", "json")
+	require.Equal(t, "{}\n", out)
+	require.False(t, client.servers[0].IsVoter)
+}
+
+func run(t *testing.T, client api.LogClient, in string, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	c := &ctl{client: client, in: strings.NewReader(in), out: &out}
+	cmd := c.command()
+	cmd.SetArgs(args)
+	require.NoError(t, cmd.Execute())
+	return out.String()
+}
+
+// メモリ上のログに読み書きするクライアント
+type logClient struct {
+	api.LogClient
+	topic   string
+	records []*api.Record
+	servers []*api.Server
+}
+
+func (c *logClient) Produce(ctx context.Context, req *api.ProduceRequest, opts ...grpc.CallOption) (*api.ProduceResponse, error) {
+	c.topic = req.Topic
+	req.Record.Offset = uint64(len(c.records))
+	c.records = append(c.records, req.Record)
+	return &api.ProduceResponse{Offset: req.Record.Offset}, nil
+}
+
+func (c *logClient) Consume(ctx context.Context, req *api.ConsumeRequest, opts ...grpc.CallOption) (*api.ConsumeResponse, error) {
+	if req.StartTime != 0 {
+		req.Offset = uint64(len(c.records))
+		for _, record := range c.records {
+			if record.Timestamp >= req.StartTime {
+				req.Offset = record.Offset
+				break
+			}
+		}
+	}
+	if req.Offset >= uint64(len(c.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}.GRPCStatus().Err()
+	}
+	return &api.ConsumeResponse{Record: c.records[req.Offset]}, nil
+}
+
+func (c *logClient) Join(ctx context.Context, req *api.JoinRequest, opts ...grpc.CallOption) (*api.JoinResponse, error) {
+	c.servers = append(c.servers, &api.Server{Id: req.Id, RpcAddr: req.RpcAddr, IsVoter: !req.NonVoter})
+	return &api.JoinResponse{}, nil
+}
+
+func (c *logClient) SetVoter(ctx context.Context, req *api.SetVoterRequest, opts ...grpc.CallOption) (*api.SetVoterResponse, error) {
+	for _, server := range c.servers {
+		if server.Id == req.Id {
+			server.IsVoter = req.Voter
+			return &api.SetVoterResponse{}, nil
+		}
+	}
+	return nil, api.ErrUnknownServer{ID: req.Id}.GRPCStatus().Err()
+}
+
+func (c *logClient) GetServers(ctx context.Context, req *api.GetServersRequest, opts ...grpc.CallOption) (*api.GetServersResponse, error) {
+	return &api.GetServersResponse{Servers: c.servers}, nil
+}
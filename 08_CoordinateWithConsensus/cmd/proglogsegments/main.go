@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	plog "github.com/lottotto/proglog/internal/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// エージェントを起動せずにデータディレクトリのセグメントを調べて修復するコマンド
+type segments struct {
+	dir    string
+	output string
+
+	out io.Writer
+}
+
+func main() {
+	s := &segments{out: os.Stdout}
+	if err := s.command().Execute(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *segments) command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proglogsegments",
+		Short: "Inspect and repair the segments of a stopped proglog log directory.",
+		Long: "Inspect and repair the <baseOffset>.store, <baseOffset>.index and <baseOffset>.timeindex files of a log directory, " +
+			"e.g. <data-dir>/log, <data-dir>/topics/<topic>/<partition> or <data-dir>/raft/log. " +
+			"Stop the agent that owns the directory first.",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if s.output != "text" && s.output != "json" {
+				return fmt.Errorf("unknown output format: %s", s.output)
+			}
+			return nil
+		},
+	}
+	flags := cmd.PersistentFlags()
+	flags.StringVarP(&s.dir, "dir", "d", ".", "Directory containing the segment files.")
+	flags.StringVarP(&s.output, "output", "o", "text", "Output format: text or json.")
+
+	cmd.AddCommand(
+		s.listCommand(),
+		s.dumpCommand(),
+		s.checkCommand(),
+		s.repairCommand(),
+	)
+	return cmd
+}
+
+func (s *segments) listCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List segments with their base and next offsets and file sizes.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			infos, err := plog.ListSegments(s.dir)
+			if err != nil {
+				return err
+			}
+			if s.output == "json" {
+				for _, info := range infos {
+					if err := s.printJSON(info); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			w := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "BASE OFFSET\tNEXT OFFSET\tSTORE BYTES\tINDEX BYTES\tTIME INDEX BYTES")
+			for _, info := range infos {
+				fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n",
+					info.BaseOffset, info.NextOffset, info.StoreBytes, info.IndexBytes, info.TimeIndexBytes,
+				)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// レコードは出力形式によらずJSONで出力する
+func (s *segments) dumpCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dump OFFSET...",
+		Short: "Print the records at the given offsets as JSON.",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			offsets := make([]uint64, 0, len(args))
+			for _, arg := range args {
+				off, err := strconv.ParseUint(arg, 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid offset: %s", arg)
+				}
+				offsets = append(offsets, off)
+			}
+			records, err := plog.ReadRecords(s.dir, offsets)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				b, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(record)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintln(s.out, string(b)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// 問題が見つかった場合はエラーで終了する
+func (s *segments) checkCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Check index entries against the store and find orphaned segment files.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems, err := plog.CheckSegments(s.dir)
+			if err != nil {
+				return err
+			}
+			for _, p := range problems {
+				if s.output == "json" {
+					err = s.printJSON(p)
+				} else {
+					_, err = fmt.Fprintf(s.out, "segment %d: %s\n", p.BaseOffset, p.Problem)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("found %d problems", len(problems))
+			}
+			return nil
+		},
+	}
+}
+
+// インデックスはログと同じ密度で作り直す必要がある
+func (s *segments) repairCommand() *cobra.Command {
+	var c plog.Config
+	cmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Truncate torn or corrupt store data and rebuild indexes from their stores.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repairs, err := plog.RepairSegments(s.dir, c)
+			if err != nil {
+				return err
+			}
+			for _, r := range repairs {
+				if s.output == "json" {
+					err = s.printJSON(r)
+				} else {
+					_, err = fmt.Fprintf(s.out,
+						"segment %d: records=%d truncated_bytes=%d index_rebuilt=%t time_index_rebuilt=%t\n",
+						r.BaseOffset, r.Records, r.TruncatedBytes, r.IndexRebuilt, r.TimeIndexRebuilt,
+					)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Uint64Var(&c.Segment.IndexIntervalRecords, "index-interval-records", 0, "Index one record every N records, as configured for the log. 0 indexes every record.")
+	cmd.Flags().Uint64Var(&c.Segment.IndexIntervalBytes, "index-interval-bytes", 0, "Index one record every N store bytes, as configured for the log.")
+	return cmd
+}
+
+func (s *segments) printJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(s.out, string(b))
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/lottotto/proglog/api/v1"
+	plog "github.com/lottotto/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l, err := plog.NewLog(dir, plog.Config{})
+	require.NoError(t, err)
+	// ファイルの大きさが決まるようにタイムスタンプを固定する
+	for i, value := range []string{"one", "two"} {
+		_, err := l.Append(&api.Record{Value: []byte(value), Timestamp: int64(i + 1)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	out, err := run(dir, "list", "-o", "json")
+	require.NoError(t, err)
+	require.Equal(t, `{"base_offset":0,"next_offset":2,"store_bytes":40,"index_bytes":24,"time_index_bytes":24}`+"\n", out)
+
+	out, err = run(dir, "dump", "1")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"value":"dHdv","offset":"1","term":"0","type":0,"key":"","timestamp":"2","headers":{},"raft_index":"0"}`, out)
+
+	out, err = run(dir, "check")
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	// インデックスを失ったセグメントは検査で見つかり、修復で作り直される
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.index")))
+	out, err = run(dir, "check")
+	require.Error(t, err)
+	require.Equal(t, "segment 0: store has no index\n", out)
+
+	out, err = run(dir, "repair")
+	require.NoError(t, err)
+	require.Equal(t, "segment 0: records=2 truncated_bytes=0 index_rebuilt=true time_index_rebuilt=false\n", out)
+
+	_, err = run(dir, "check")
+	require.NoError(t, err)
+}
+
+func run(dir string, args ...string) (string, error) {
+	var out bytes.Buffer
+	s := &segments{out: &out}
+	cmd := s.command()
+	cmd.SetArgs(append([]string{"--dir", dir}, args...))
+	cmd.SetErr(&bytes.Buffer{})
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestRepairSparseIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := plog.Config{}
+	c.Segment.IndexIntervalRecords = 2
+	l, err := plog.NewLog(dir, c)
+	require.NoError(t, err)
+	for _, value := range []string{"one", "two", "three"} {
+		_, err := l.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// ログと同じ密度を指定すれば、正常なインデックスは作り直さない
+	out, err := run(dir, "repair", "--index-interval-records", "2")
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	out, err = run(dir, "list", "-o", "json")
+	require.NoError(t, err)
+	require.Contains(t, out, `"next_offset":3,`)
+	require.Contains(t, out, `"index_bytes":24,`)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -28,6 +29,7 @@ type Agent struct {
 	log        *log.DistributedLog
 	server     *grpc.Server
 	membership *discovery.Membership
+	forwarder  *forwarder
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -45,6 +47,16 @@ type Config struct {
 	ACLModelFile    string
 	ACLPolicyFile   string
 	Bootstrap       bool
+	// trueの場合は投票権を持たない読み出し専用のレプリカとしてクラスタに参加し、リーダーの選出とコミットの遅延に影響しない
+	ReadReplica bool
+	// raftの調整。StreamLayer、LocalID、Bootstrapはエージェントが設定する
+	Raft log.RaftConfig
+	// セグメントの大きさ、永続化、インデックスの設定。raftのログにも使う
+	Segment log.SegmentConfig
+	// 古いセグメントを削除する条件。raftのログには適用しない
+	Retention log.RetentionConfig
+	// 停止する時に処理中のRPCの終了を待つ時間。過ぎると終わっていないConsumeStreamなどを切断する。0の場合は10秒
+	ShutdownTimeout time.Duration
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -56,6 +68,12 @@ func (c Config) RPCAddr() (string, error) {
 }
 
 func New(config Config) (*Agent, error) {
+	if config.Bootstrap && config.ReadReplica {
+		return nil, fmt.Errorf("a read replica cannot bootstrap the cluster")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 10 * time.Second
+	}
 	a := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
@@ -77,7 +95,11 @@ func New(config Config) (*Agent, error) {
 }
 
 func (a *Agent) setupMux() error {
-	rpcAddr := fmt.Sprintf(":%d", a.Config.RPCPort)
+	// raftのアドレスとしてリーダーのアドレスが他のサーバから使われるので、全てのアドレスではなくRPCAddrで待ち受ける
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
 	ln, err := net.Listen("tcp", rpcAddr)
 	if err != nil {
 		return err
@@ -106,6 +128,9 @@ func (a *Agent) setupLog() error {
 		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
 	})
 	logConfig := log.Config{}
+	logConfig.Segment = a.Config.Segment
+	logConfig.Retention = a.Config.Retention
+	logConfig.Raft = a.Config.Raft
 	logConfig.Raft.StreamLayer = log.NewStreamLayer(
 		raftLn,
 		a.Config.ServerTLSConfig,
@@ -134,9 +159,16 @@ func (a *Agent) setupServer() error {
 		a.Config.ACLModelFile,
 		a.Config.ACLPolicyFile,
 	)
+	a.forwarder = newForwarder(a)
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		CommitLog:       a.log,
+		Authorizer:      authorizer,
+		OffsetStore:     a.log,
+		Topics:          topicManager{a.log},
+		ReadBarrier:     a.log,
+		Forwarder:       a.forwarder,
+		ServerRetriever: a.log,
+		ClusterManager:  a.log,
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -159,6 +191,20 @@ func (a *Agent) setupServer() error {
 }
 
 // raftのおかげでDistributedLogが連携されたレプリケーションを処理するので,replicatorは不要
+// DistributedLogのTopicが*log.Topicを返すので、server.TopicManagerに合わせる
+type topicManager struct {
+	*log.DistributedLog
+}
+
+func (t topicManager) Topic(name string, partition uint32) (server.CommitLog, error) {
+	// nilの*log.Topicをインターフェースとして返さないようにする
+	topic, err := t.DistributedLog.Topic(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	return topic, nil
+}
+
 func (a *Agent) setupMembership() error {
 
 	rpcAddr, err := a.Config.RPCAddr()
@@ -170,7 +216,8 @@ func (a *Agent) setupMembership() error {
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
+			"rpc_addr":         rpcAddr,
+			discovery.VoterTag: strconv.FormatBool(!a.Config.ReadReplica),
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
 	})
@@ -178,7 +225,22 @@ func (a *Agent) setupMembership() error {
 	return err
 }
 
+// 再起動のためにエージェントを停止する。raftの構成には残るので、同じデータディレクトリで起動し直すとクラスタに戻る
 func (a *Agent) Shutdown() error {
+	return a.stop(a.membership.Shutdown)
+}
+
+// クラスタから恒久的に離脱してからエージェントを停止する。リーダーが離脱の通知を受け取り、raftの構成から取り除く
+func (a *Agent) Leave() error {
+	return a.stop(func() error {
+		if err := a.membership.Leave(); err != nil {
+			return err
+		}
+		return a.membership.Shutdown()
+	})
+}
+
+func (a *Agent) stop(leave func() error) error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
 	if a.shutdown {
@@ -188,13 +250,13 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
-		a.membership.Leave,
+		// 離脱する場合は新しいリーダーが離脱の通知を受け取れるように、先にリーダーを引き継ぐ
+		a.transferLeadership,
+		leave,
 		// replicatorは使わないので、削除する
 		// a.replicator.Close,
-		func() error {
-			a.server.GracefulStop()
-			return nil
-		},
+		a.stopServer,
+		a.forwarder.Close,
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
@@ -205,6 +267,30 @@ func (a *Agent) Shutdown() error {
 	return nil
 }
 
+// 他に投票者がいないなどで引き継げない場合も停止は続ける
+func (a *Agent) transferLeadership() error {
+	if err := a.log.TransferLeadership(); err != nil {
+		zap.L().Named("agent").Warn("failed to transfer leadership", zap.Error(err))
+	}
+	return nil
+}
+
+// 処理中のRPCの終了を待つ。ConsumeStreamはクライアントが閉じるまで終わらないので、ShutdownTimeoutが過ぎたら切断する
+func (a *Agent) stopServer() error {
+	stopped := make(chan struct{})
+	go func() {
+		a.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(a.Config.ShutdownTimeout):
+		a.server.Stop()
+		<-stopped
+	}
+	return nil
+}
+
 func (a *Agent) serve() error {
 	if err := a.mux.Serve(); err != nil {
 		_ = a.Shutdown()
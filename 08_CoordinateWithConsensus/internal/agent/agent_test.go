@@ -5,12 +5,14 @@ import (
 	"crypto/tls"
 	"fmt"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
 	api "github.com/lottotto/proglog/api/v1"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 
@@ -21,23 +23,7 @@ import (
 )
 
 func TestAgent(t *testing.T) {
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
-		Server:        true,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
-	// peerとserverの違いって何？
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.RootClientCertFile,
-		KeyFile:       config.RootClientKeyFile,
-		CAFile:        config.CAFile,
-		Server:        false,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
+	serverTLSConfig, peerTLSConfig := setupTLSConfigs(t)
 
 	var agents []*agent.Agent
 	// ここからクラスタ作るところ
@@ -64,6 +50,7 @@ func TestAgent(t *testing.T) {
 			ACLModelFile:    config.ACLModelFile,
 			ACLPolicyFile:   config.ACLPolicyFile,
 			Bootstrap:       i == 0, // 最初のノードだけtrueになる。本当はテストコードにロジックを入れないほうがいいと思うけど。。。
+			ReadReplica:     i == 2,
 		})
 		require.NoError(t, err)
 		agents = append(agents, agent)
@@ -126,6 +113,221 @@ func TestAgent(t *testing.T) {
 	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
 	require.Equal(t, want, got)
 
+	// フォロワーへの書き込みはリーダーに転送される
+	produceResponse, err = followerClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), consumeResponse.Record.Value)
+
+	// 読み出し専用のレプリカは投票権を持たずに参加し、書き込みを複製する
+	requireVoters(t, leaderClient, true, true, false)
+	replicaClient := client(t, agents[2], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := replicaClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{Offset: produceResponse.Offset},
+		)
+		return err == nil && string(res.Record.Value) == "bar"
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// 管理用のRPCで昇格、降格できる。フォロワーが受け取った場合はリーダーに転送される
+	_, err = followerClient.SetVoter(
+		context.Background(),
+		&api.SetVoterRequest{Id: "2", Voter: true},
+	)
+	require.NoError(t, err)
+	requireVoters(t, leaderClient, true, true, true)
+	_, err = leaderClient.SetVoter(
+		context.Background(),
+		&api.SetVoterRequest{Id: "1", Voter: false},
+	)
+	require.NoError(t, err)
+	requireVoters(t, leaderClient, true, false, true)
+	_, err = leaderClient.SetVoter(
+		context.Background(),
+		&api.SetVoterRequest{Id: "3", Voter: true},
+	)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAgentShutdown(t *testing.T) {
+	serverTLSConfig, peerTLSConfig := setupTLSConfigs(t)
+
+	var agents []*agent.Agent
+	var configs []agent.Config
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := os.MkdirTemp("", "agent-shutdown-test")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, configs[0].BindAddr)
+		}
+		cfg := agent.Config{
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			DataDir:         dataDir,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			Bootstrap:       i == 0,
+			ShutdownTimeout: 500 * time.Millisecond,
+		}
+		a, err := agent.New(cfg)
+		require.NoError(t, err)
+		agents = append(agents, a)
+		configs = append(configs, cfg)
+	}
+	defer func() {
+		for i, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(configs[i].DataDir))
+		}
+	}()
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	requireServers(t, leaderClient, "0", "0", "1", "2")
+
+	produceResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}},
+	)
+	require.NoError(t, err)
+
+	// 終わらないConsumeStreamがあってもShutdownTimeoutが過ぎれば停止する
+	stream, err := leaderClient.ConsumeStream(
+		context.Background(),
+		&api.ConsumeRequest{Offset: produceResponse.Offset},
+	)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, agents[0].Shutdown())
+	require.Less(t, time.Since(start), 5*time.Second)
+	_, err = stream.Recv()
+	require.Error(t, err)
+
+	// リーダーは引き継がれ、停止したノードはraftの構成に残る
+	followerClient := client(t, agents[1], peerTLSConfig)
+	leader := requireNewLeader(t, followerClient, "0")
+	requireServers(t, followerClient, leader, "0", "1", "2")
+	produceResponse, err = followerClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("bar")}},
+	)
+	require.NoError(t, err)
+
+	// 同じデータディレクトリで起動し直すとクラスタに戻り、停止中の書き込みを複製する
+	restart := configs[0]
+	restart.Bootstrap = false
+	restart.StartJoinAddrs = []string{configs[1].BindAddr}
+	agents[0], err = agent.New(restart)
+	require.NoError(t, err)
+	restartedClient := client(t, agents[0], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := restartedClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{Offset: produceResponse.Offset},
+		)
+		return err == nil && string(res.Record.Value) == "bar"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// 離脱したノードはraftの構成から取り除かれる。リーダーの場合は先に引き継ぐ
+	id, err := strconv.Atoi(leader)
+	require.NoError(t, err)
+	require.NoError(t, agents[id].Leave())
+	remaining := agents[3-id]
+	remainingID := fmt.Sprintf("%d", 3-id)
+	remainingClient := client(t, remaining, peerTLSConfig)
+	leader = requireNewLeader(t, remainingClient, leader)
+	requireServers(t, remainingClient, leader, "0", remainingID)
+}
+
+// leaderでないリーダーが選ばれるまで待ち、そのIDを返す
+func requireNewLeader(t *testing.T, client api.LogClient, leader string) string {
+	t.Helper()
+	var id string
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+		if err != nil {
+			return false
+		}
+		for _, server := range res.Servers {
+			if server.IsLeader && server.Id != leader {
+				id = server.Id
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+	return id
+}
+
+// raftの構成がIDの順に並んだidsになり、leaderがリーダーになるまで待つ
+func requireServers(t *testing.T, client api.LogClient, leader string, ids ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+		if err != nil || len(res.Servers) != len(ids) {
+			return false
+		}
+		for i, server := range res.Servers {
+			if server.Id != ids[i] || server.IsLeader != (server.Id == leader) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func setupTLSConfigs(t *testing.T) (serverTLSConfig, peerTLSConfig *tls.Config) {
+	t.Helper()
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	// peerとserverの違いって何？
+	peerTLSConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	return serverTLSConfig, peerTLSConfig
+}
+
+// IDの順に並んだサーバの投票権を確認する
+func requireVoters(t *testing.T, client api.LogClient, voters ...bool) {
+	t.Helper()
+	res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, len(voters))
+	for i, server := range res.Servers {
+		require.Equal(t, fmt.Sprintf("%d", i), server.Id)
+		require.Equal(t, voters[i], server.IsVoter)
+	}
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
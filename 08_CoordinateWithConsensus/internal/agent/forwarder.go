@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// フォロワーが受け取った書き込みを、cmuxのリスナーで待ち受けているリーダーのgRPCサーバに転送する。
+// リーダーのアドレスはserfのメンバーのrpc_addrタグから求め、PeerTLSConfigで接続する。
+type forwarder struct {
+	agent *Agent
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newForwarder(agent *Agent) *forwarder {
+	return &forwarder{
+		agent: agent,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (f *forwarder) LeaderClient() (api.LogClient, error) {
+	addr, err := f.leaderAddr()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn, ok := f.conns[addr]
+	if !ok {
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		if f.agent.Config.PeerTLSConfig != nil {
+			creds := credentials.NewTLS(f.agent.Config.PeerTLSConfig)
+			opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+		}
+		conn, err = grpc.Dial(addr, opts...)
+		if err != nil {
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	return api.NewLogClient(conn), nil
+}
+
+// リーダーのrpc_addrを返す。serfのメンバーにリーダーが見つからない場合はraftのアドレスを使う
+func (f *forwarder) leaderAddr() (string, error) {
+	id, addr := f.agent.log.Leader()
+	if id == "" {
+		return "", fmt.Errorf("no leader")
+	}
+	if f.agent.membership != nil {
+		for _, member := range f.agent.membership.Members() {
+			if member.Name == id && member.Tags["rpc_addr"] != "" {
+				return member.Tags["rpc_addr"], nil
+			}
+		}
+	}
+	return addr, nil
+}
+
+func (f *forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, conn := range f.conns {
+		if err := conn.Close(); err != nil {
+			return err
+		}
+		delete(f.conns, addr)
+	}
+	return nil
+}
@@ -3,8 +3,8 @@ package discovery
 import (
 	"net"
 
-	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	api "github.com/lottotto/proglog/api/v1"
 	"go.uber.org/zap"
 )
 
@@ -23,8 +23,11 @@ type Config struct {
 	StartJoinAddrs []string
 }
 
+// voterタグが"false"のメンバーは投票権を持たないサーバとして参加させる
+const VoterTag = "voter"
+
 type Handler interface {
-	Join(name, addr string) error
+	Join(name, addr string, voter bool) error
 	Leave(names string) error
 }
 
@@ -81,7 +84,9 @@ func (m *Membership) eventHandler() {
 				}
 				m.handleJoin(member)
 			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
+		// 応答がなくなったメンバーは再起動中かもしれないので、raftの構成には残す。
+		// 明示的に離脱したか、serfが故障したメンバーを諦めた場合に取り除く
+		case serf.EventMemberLeave, serf.EventMemberReap:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
 					return
@@ -96,6 +101,7 @@ func (m *Membership) handleJoin(member serf.Member) {
 	if err := m.handler.Join(
 		member.Name,
 		member.Tags["rpc_addr"],
+		member.Tags[VoterTag] != "false",
 	); err != nil {
 		m.logError(err, "failed to join", member)
 	}
@@ -115,14 +121,20 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// クラスタから離脱したことを他のメンバーに伝える
 func (m *Membership) Leave() error {
 	return m.serf.Leave()
 }
 
+// 離脱を伝えずにserfを止める。他のメンバーからは故障したように見える
+func (m *Membership) Shutdown() error {
+	return m.serf.Shutdown()
+}
+
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	log := m.logger.Error
 	// リーダーではない場合、デバッグレベルでエラーを吐く
-	if err != raft.ErrNotLeader {
+	if _, ok := err.(api.ErrNotLeader); !ok {
 		log = m.logger.Debug
 	}
 	log(
@@ -68,12 +68,13 @@ type handler struct {
 	leaves chan string
 }
 
-func (h *handler) Join(id, addr string) error {
+func (h *handler) Join(id, addr string, voter bool) error {
 	if h.joins != nil {
 		// joinsが空っぽじゃ無かったら、channelに書きのmapオブジェクトをぶち込む(チャンネルにはサイズの考え方があるはず。)
 		h.joins <- map[string]string{
-			"id":   id,
-			"addr": addr,
+			"id":    id,
+			"addr":  addr,
+			"voter": fmt.Sprintf("%t", voter),
 		}
 	}
 	return nil
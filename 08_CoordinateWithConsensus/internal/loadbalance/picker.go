@@ -0,0 +1,106 @@
+package loadbalance
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+)
+
+var _ base.PickerBuilder = (*Picker)(nil)
+
+// 読み出しをフォロワーに分散し、それ以外のRPCはリーダーに送るピッカー。
+// ConsumeとConsumeStreamは読み出し専用のレプリカにラウンドロビンで送り、レプリカがいない場合はフォロワー、フォロワーもいない場合はリーダーに送る。
+// ピッカーはリクエストを見られないので、LEADERとLINEARIZABLEの読み出しはWithConsistencyで一貫性を指定したコンテキストで呼び出すとリーダーに送る。
+type Picker struct {
+	mu        sync.RWMutex
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	// 投票権を持たないレプリカ。コミットに参加しないので、読み出しを集めてもクォーラムを遅らせない
+	replicas []balancer.SubConn
+	current  uint64
+}
+
+func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.leader = nil
+	var followers, replicas []balancer.SubConn
+	for sc, scInfo := range buildInfo.ReadySCs {
+		switch {
+		case isLeader(scInfo.Address):
+			p.leader = sc
+		case isReadReplica(scInfo.Address):
+			replicas = append(replicas, sc)
+		default:
+			followers = append(followers, sc)
+		}
+	}
+	p.followers = followers
+	p.replicas = replicas
+	return p
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result balancer.PickResult
+	read := isRead(info.FullMethodName) && consistency(info.Ctx) == api.Consistency_LOCAL
+	switch {
+	case read && len(p.replicas) > 0:
+		result.SubConn = p.next(p.replicas)
+	case read && len(p.followers) > 0:
+		result.SubConn = p.next(p.followers)
+	default:
+		result.SubConn = p.leader
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+// /log.v1.Log/Consume と /log.v1.Log/ConsumeStream
+func isRead(method string) bool {
+	return strings.HasPrefix(method[strings.LastIndex(method, "/")+1:], "Consume")
+}
+
+// ピッカーに読み出しの一貫性を伝えるメタデータのキー
+const consistencyKey = "proglog-consistency"
+
+// ctxで呼び出すConsumeとConsumeStreamの一貫性をピッカーに伝える。ConsumeRequestのConsistencyと同じ値を指定する
+func WithConsistency(ctx context.Context, level api.Consistency) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, consistencyKey, level.String())
+}
+
+// 指定されていない場合はLOCAL
+func consistency(ctx context.Context) api.Consistency {
+	if ctx == nil {
+		return api.Consistency_LOCAL
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	values := md.Get(consistencyKey)
+	if len(values) == 0 {
+		return api.Consistency_LOCAL
+	}
+	return api.Consistency(api.Consistency_value[values[len(values)-1]])
+}
+
+func (p *Picker) next(scs []balancer.SubConn) balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	idx := int(cur % uint64(len(scs)))
+	return scs[idx]
+}
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
+	)
+}
@@ -0,0 +1,170 @@
+package loadbalance_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/lottotto/proglog/internal/loadbalance"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := &loadbalance.Picker{}
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupPicker(0)
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/ProduceBatch",
+		"/log.v1.Log/CommitOffset",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		for i := 0; i < 5; i++ {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], gotPick.SubConn)
+		}
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPicker(0)
+	info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"}
+	seen := make(map[balancer.SubConn]int)
+	for i := 0; i < 6; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotEqual(t, subConns[0], pick.SubConn)
+		seen[pick.SubConn]++
+	}
+	// 2台のフォロワーに交互に送られる
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 3, subConns[2]: 3}, seen)
+}
+
+// LEADERとLINEARIZABLEの読み出しは、レプリカやフォロワーがいてもリーダーに送る
+func TestPickerConsumesFromLeaderWithConsistency(t *testing.T) {
+	picker, subConns := setupPicker(1)
+	for level, want := range map[api.Consistency]*subConn{
+		api.Consistency_LOCAL:        subConns[3],
+		api.Consistency_LEADER:       subConns[0],
+		api.Consistency_LINEARIZABLE: subConns[0],
+	} {
+		for _, method := range []string{
+			"/log.v1.Log/Consume",
+			"/log.v1.Log/ConsumeStream",
+		} {
+			info := balancer.PickInfo{
+				FullMethodName: method,
+				Ctx:            loadbalance.WithConsistency(context.Background(), level),
+			}
+			pick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, want, pick.SubConn, "%s %s", method, level)
+		}
+	}
+}
+
+// 投票権を持たないレプリカがいる場合は、読み出しをレプリカだけに送る
+func TestPickerConsumesFromReadReplicas(t *testing.T) {
+	picker, subConns := setupPicker(1)
+	info := balancer.PickInfo{FullMethodName: "/log.v1.Log/ConsumeStream"}
+	for i := 0; i < 4; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[3], pick.SubConn)
+	}
+	pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
+}
+
+// 0番目のサブコネクションがリーダー、1番目と2番目がフォロワーで、その後にreplicas台の投票権を持たないレプリカが続く
+func setupPicker(replicas int) (*loadbalance.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3+replicas; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New("is_leader", i == 0).
+				WithValue("is_voter", i < 3),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := &loadbalance.Picker{}
+	picker.Build(buildInfo)
+	return picker, subConns
+}
+
+type subConn struct {
+	balancer.SubConn
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
+
+// フォロワーのアドレスだけを知っているクライアントから、リーダーへの書き込みとフォロワーからの読み出しができる
+func TestPickerCluster(t *testing.T) {
+	agents, clientTLSConfig := setupCluster(t, 3)
+
+	followerAddr, err := agents[1].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		"proglog:///"+followerAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+
+	// フォロワーに複製されるまで待つ
+	require.Eventually(t, func() bool {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: produce.Offset,
+		})
+		return err == nil && string(consume.Record.Value) == "foo"
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// LINEARIZABLEの読み出しはリーダーに送られるので、直前の書き込みを待たずに読み出せる
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("bar")},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(
+		loadbalance.WithConsistency(ctx, api.Consistency_LINEARIZABLE),
+		&api.ConsumeRequest{Offset: produce.Offset, Consistency: api.Consistency_LINEARIZABLE},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), consume.Record.Value)
+}
@@ -0,0 +1,123 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// proglog:///<アドレス>のターゲットを解決するリゾルバ。
+// 指定されたサーバにGetServersでクラスタのサーバの一覧を問い合わせ、どのサーバがリーダーか、投票権を持つかを属性としてアドレスに付ける。
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+}
+
+var _ resolver.Builder = (*Resolver)(nil)
+
+// リゾルバとピッカーの名前。ターゲットのスキームとしても使う
+const Name = "proglog"
+
+// アドレスの属性のキー。値はbool
+const (
+	isLeaderKey = "is_leader"
+	isVoterKey  = "is_voter"
+)
+
+func (r *Resolver) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	r.logger = zap.L().Named("resolver")
+	r.clientConn = cc
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(
+			dialOpts,
+			grpc.WithTransportCredentials(opts.DialCreds),
+		)
+	}
+	// このリゾルバで作られた接続ではproglogのピッカーを使う
+	r.serviceConfig = r.clientConn.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	return r, nil
+}
+
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// gRPCが接続に失敗した時などにも呼ばれる
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := api.NewLogClient(r.resolverConn)
+	res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve server", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		attrs := attributes.New(isLeaderKey, server.IsLeader).
+			WithValue(isVoterKey, server.IsVoter)
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attrs,
+		})
+	}
+	if err := r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update state", zap.Error(err))
+	}
+}
+
+func (r *Resolver) Close() {
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
+
+func isLeader(addr resolver.Address) bool {
+	if addr.Attributes == nil {
+		return false
+	}
+	leader, _ := addr.Attributes.Value(isLeaderKey).(bool)
+	return leader
+}
+
+// 投票権を持たない読み出し専用のレプリカかどうか。属性がない場合は投票者として扱う
+func isReadReplica(addr resolver.Address) bool {
+	if addr.Attributes == nil {
+		return false
+	}
+	voter, ok := addr.Attributes.Value(isVoterKey).(bool)
+	return ok && !voter
+}
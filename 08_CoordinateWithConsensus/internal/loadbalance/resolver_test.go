@@ -0,0 +1,154 @@
+package loadbalance_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/lottotto/proglog/internal/agent"
+	"github.com/lottotto/proglog/internal/config"
+	"github.com/lottotto/proglog/internal/loadbalance"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	agents, clientTLSConfig := setupCluster(t, 3)
+
+	// フォロワーに問い合わせても、リーダーを含むクラスタの全てのサーバが返る
+	followerAddr, err := agents[1].Config.RPCAddr()
+	require.NoError(t, err)
+	conn := &clientConn{}
+	r := &loadbalance.Resolver{}
+	_, err = r.Build(
+		resolver.Target{Endpoint: followerAddr},
+		conn,
+		resolver.BuildOptions{DialCreds: credentials.NewTLS(clientTLSConfig)},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var want []resolver.Address
+	for i, a := range agents {
+		addr, err := a.Config.RPCAddr()
+		require.NoError(t, err)
+		want = append(want, resolver.Address{Addr: addr})
+		if i == 0 {
+			require.True(t, isLeader(conn.state.Addresses, addr))
+		} else {
+			require.False(t, isLeader(conn.state.Addresses, addr))
+		}
+	}
+	require.ElementsMatch(t, addrs(want), addrs(conn.state.Addresses))
+}
+
+// 属性を除いたアドレスの一覧
+func addrs(as []resolver.Address) []string {
+	var s []string
+	for _, a := range as {
+		s = append(s, a.Addr)
+	}
+	return s
+}
+
+func isLeader(as []resolver.Address, addr string) bool {
+	for _, a := range as {
+		if a.Addr == addr {
+			leader, _ := a.Attributes.Value("is_leader").(bool)
+			return leader
+		}
+	}
+	return false
+}
+
+// リゾルバが更新した状態を記録する
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
+
+// n台のエージェントのクラスタを起動し、全てのサーバがraftに参加するまで待つ。最初のエージェントがリーダーになる
+func setupCluster(t *testing.T, n int) ([]*agent.Agent, *tls.Config) {
+	t.Helper()
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*agent.Agent
+	for i := 0; i < n; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := os.MkdirTemp("", "loadbalance-test")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+		a, err := agent.New(agent.Config{
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			DataDir:         dataDir,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			Bootstrap:       i == 0,
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+	}
+	t.Cleanup(func() {
+		for _, a := range agents {
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, os.RemoveAll(a.Config.DataDir))
+		}
+	})
+
+	leaderAddr, err := agents[0].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		leaderAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == n
+	}, 5*time.Second, 50*time.Millisecond)
+	return agents, peerTLSConfig
+}
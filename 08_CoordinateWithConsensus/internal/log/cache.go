@@ -0,0 +1,121 @@
+package log
+
+import (
+	"container/list"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// 封印されたセグメントのうちファイルとmmapを開いたままにしておく数を制限するLRU。
+// セグメントが多くてもファイルディスクリプタとmmapの数がmaxを超えないように、最近読まれていないセグメントから閉じる。
+// 読み出し中のセグメントは閉じないので、一時的にmaxを超えることがある。アクティブセグメントは管理しない。
+type segmentCache struct {
+	mu  sync.Mutex
+	max int
+	// 開いている封印済みのセグメント。先頭が最近使ったもの
+	lru    *list.List
+	logger *zap.Logger
+}
+
+func newSegmentCache(max int, logger *zap.Logger) *segmentCache {
+	return &segmentCache{
+		max:    max,
+		lru:    list.New(),
+		logger: logger,
+	}
+}
+
+// 封印されたセグメントを管理に加える。セグメントは開いた状態で渡す。
+func (c *segmentCache) add(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.elem = c.lru.PushFront(s)
+	c.evict()
+}
+
+// セグメントを読み出せるように開き、releaseされるまで閉じないようにする。
+func (c *segmentCache) acquire(s *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.removed {
+		return os.ErrClosed
+	}
+	if s.store == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+		s.elem = c.lru.PushFront(s)
+	} else if s.elem != nil {
+		c.lru.MoveToFront(s.elem)
+	}
+	s.refs++
+	c.evict()
+	return nil
+}
+
+func (c *segmentCache) release(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.refs--
+	c.evict()
+}
+
+// セグメントを閉じたり削除したりする前に管理から外す。外したセグメントはacquireできない。
+func (c *segmentCache) remove(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.elem != nil {
+		c.lru.Remove(s.elem)
+		s.elem = nil
+	}
+	s.removed = true
+}
+
+// 封印されたセグメントのストアとインデックスの大きさを返す。閉じられている間は閉じた時の大きさを返す。
+func (c *segmentCache) sizes(s *segment) (store, index, timeIndex uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.store == nil {
+		return s.storeSize, s.indexSize, s.timeIndexSize
+	}
+	return s.store.size, s.index.size, s.timeIndex.size
+}
+
+// 封印されたセグメントを開いて管理から外し、再びアクティブセグメントとして書き込めるようにする。
+func (c *segmentCache) unseal(s *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s.store == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.elem != nil {
+		c.lru.Remove(s.elem)
+		s.elem = nil
+	}
+	return nil
+}
+
+// 開いているセグメントがmaxを超えていれば、読み出し中でないものを古い順に閉じる。
+func (c *segmentCache) evict() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.max; {
+		prev := e.Prev()
+		s := e.Value.(*segment)
+		if s.refs == 0 {
+			c.lru.Remove(e)
+			s.elem = nil
+			// 閉じられなくても次に読む時に開き直すので、ログに残すだけにする
+			if err := s.Close(); err != nil {
+				c.logger.Error(
+					"failed to close segment",
+					zap.Uint64("base_offset", s.baseOffset),
+					zap.Error(err),
+				)
+			}
+		}
+		e = prev
+	}
+}
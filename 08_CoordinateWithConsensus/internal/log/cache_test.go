@@ -0,0 +1,84 @@
+package log
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	// 1つのセグメントに1つのレコードだけを書き込む
+	c.Segment.MaxIndexBytes = entWidth
+	c.Segment.MaxOpenSegments = 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	require.Len(t, l.segments, 10)
+	// アクティブセグメントを除いて開いているのは2つだけ
+	require.Equal(t, 2, l.cache.lru.Len())
+	require.Equal(t, 2, openSegments(l))
+
+	// 閉じたセグメントも開き直して読める
+	for i := uint64(0); i < 10; i++ {
+		read, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.LessOrEqual(t, openSegments(l), 2)
+	}
+	// 最近読んだセグメントが開いたまま残る
+	require.NotNil(t, l.segments[8].store)
+	require.NotNil(t, l.segments[7].store)
+	require.Nil(t, l.segments[0].store)
+	require.NotNil(t, l.activeSegment.store)
+
+	// 閉じているセグメントも大きさを返し、Readerで読める
+	require.NotZero(t, l.segments[0].size())
+	b, err := io.ReadAll(l.Reader())
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+
+	// 閉じているセグメントも削除できる
+	require.NoError(t, l.Truncate(4))
+	require.Len(t, l.segments, 5)
+	_, err = os.Stat(l.segments[0].storeName())
+	require.NoError(t, err)
+	_, err = l.Read(4)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	read, err := l.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), read.Offset)
+	require.NoError(t, l.Close())
+
+	// 開き直した時も封印済みのセグメントは制限される
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 2, openSegments(l))
+	read, err = l.Read(9)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), read.Offset)
+	require.NoError(t, l.Close())
+}
+
+// アクティブセグメントを除いて開いているセグメントの数
+func openSegments(l *Log) int {
+	var n int
+	for _, s := range l.segments {
+		if s != l.activeSegment && s.store != nil {
+			n++
+		}
+	}
+	return n
+}
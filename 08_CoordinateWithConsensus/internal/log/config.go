@@ -1,16 +1,173 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
-	Raft struct {
-		raft.Config
-		StreamLayer *StreamLayer
-		Bootstrap   bool
+	Raft      RaftConfig
+	Segment   SegmentConfig
+	Retention RetentionConfig
+}
+
+type SegmentConfig struct {
+	MaxStoreBytes uint64
+	MaxIndexBytes uint64
+	InitialOffset uint64
+	// Appendが返るまでにどこまでの永続化を保証するか
+	Sync SyncPolicy
+	// SyncGroupの時に、まとめてfsyncする間隔とバイト数。SyncBytesが0の場合は間隔のみで同期する
+	SyncInterval time.Duration
+	SyncBytes    uint64
+	// ファイルとmmapを開いたままにしておく封印済みのセグメントの数。0の場合は64
+	MaxOpenSegments uint64
+	// インデックスの密度。前のエントリからIndexIntervalRecords個のレコード、もしくはIndexIntervalBytesバイト以上離れたレコードだけをインデックスに記録する。
+	// どちらも0の場合は全てのレコードを記録する。セグメントの最初のレコードは常に記録する
+	IndexIntervalRecords uint64
+	IndexIntervalBytes   uint64
+}
+
+// 古いセグメントを削除する条件。アクティブセグメントは削除しない
+type RetentionConfig struct {
+	// ログ全体のバイト数の上限
+	MaxBytes uint64
+	// 最後に書き込まれてからセグメントを保持する期間
+	MaxAge time.Duration
+	// 保持する最小のオフセット。これより前のレコードだけを含むセグメントを削除する
+	MinOffset uint64
+	// 条件を確認する間隔。0の場合は1分
+	CheckInterval time.Duration
+}
+
+// raftの設定。埋め込んだraft.Configの値をそのまま使い、0の値はraft.DefaultConfigの値を使う。
+// ShutdownOnRemoveはゼロ値と区別できないので、常にraft.DefaultConfigと同じくtrueにする
+type RaftConfig struct {
+	raft.Config
+	StreamLayer *StreamLayer
+	Bootstrap   bool
+	// LINEARIZABLEの読み出しでコミット済みのエントリの適用を待つ時間。0の場合は1秒
+	ReadTimeout time.Duration
+	// 保持するスナップショットの数。0の場合は1
+	SnapshotRetain int
+	// トランスポートがピアごとに保持するコネクションの数。0の場合は5
+	MaxPool int
+	// トランスポートのI/Oのタイムアウト。0の場合は10秒
+	TransportTimeout time.Duration
+	// エントリをraftに適用させる時のタイムアウト。0の場合は10秒
+	ApplyTimeout time.Duration
+}
+
+// 0の値をデフォルト値で埋める。
+func (c *RaftConfig) setDefaults() {
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = time.Second
+	}
+	if c.SnapshotRetain == 0 {
+		c.SnapshotRetain = 1
+	}
+	if c.MaxPool == 0 {
+		c.MaxPool = 5
+	}
+	if c.TransportTimeout == 0 {
+		c.TransportTimeout = 10 * time.Second
+	}
+	if c.ApplyTimeout == 0 {
+		c.ApplyTimeout = 10 * time.Second
+	}
+}
+
+// 埋め込んだraft.Configの0の値をraft.DefaultConfigの値で埋め、起動する前に検証したraftの設定を返す。
+func (c RaftConfig) raftConfig() (*raft.Config, error) {
+	switch {
+	case c.ReadTimeout < 0:
+		return nil, fmt.Errorf("raft read timeout must not be negative")
+	case c.SnapshotRetain < 0:
+		return nil, fmt.Errorf("raft snapshot retain must not be negative")
+	case c.MaxPool < 0:
+		return nil, fmt.Errorf("raft max pool must not be negative")
+	case c.TransportTimeout < 0:
+		return nil, fmt.Errorf("raft transport timeout must not be negative")
+	case c.ApplyTimeout < 0:
+		return nil, fmt.Errorf("raft apply timeout must not be negative")
+	}
+	config := c.Config
+	defaults := raft.DefaultConfig()
+	if config.ProtocolVersion == 0 {
+		config.ProtocolVersion = defaults.ProtocolVersion
+	}
+	if config.HeartbeatTimeout == 0 {
+		config.HeartbeatTimeout = defaults.HeartbeatTimeout
 	}
-	Segment struct {
-		MaxStoreBytes uint64
-		MaxIndexBytes uint64
-		InitialOffset uint64
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = defaults.ElectionTimeout
+	}
+	if config.CommitTimeout == 0 {
+		config.CommitTimeout = defaults.CommitTimeout
+	}
+	if config.MaxAppendEntries == 0 {
+		config.MaxAppendEntries = defaults.MaxAppendEntries
+	}
+	config.ShutdownOnRemove = defaults.ShutdownOnRemove
+	if config.TrailingLogs == 0 {
+		config.TrailingLogs = defaults.TrailingLogs
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = defaults.SnapshotInterval
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = defaults.SnapshotThreshold
+	}
+	if config.LeaderLeaseTimeout == 0 {
+		config.LeaderLeaseTimeout = defaults.LeaderLeaseTimeout
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = defaults.LogLevel
+	}
+	if err := raft.ValidateConfig(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// 相対オフセットoff、ストアの位置posのレコードをインデックスに記録するかどうか。lastOffとlastPosは最後に記録したエントリ
+func (c Config) shouldIndex(off, pos uint64, lastOff, lastPos uint64, empty bool) bool {
+	seg := c.Segment
+	if empty || (seg.IndexIntervalRecords == 0 && seg.IndexIntervalBytes == 0) {
+		return true
+	}
+	if seg.IndexIntervalRecords != 0 && off-lastOff >= seg.IndexIntervalRecords {
+		return true
+	}
+	return seg.IndexIntervalBytes != 0 && pos-lastPos >= seg.IndexIntervalBytes
+}
+
+type SyncPolicy uint8
+
+const (
+	// 未指定。通常のログではSyncOS、raftのログストアではSyncAlwaysとして扱う
+	SyncDefault SyncPolicy = iota
+	// Appendのたびにバッファをファイルへ書き出すが、fsyncはOSに任せる。プロセスが落ちてもレコードは残る
+	SyncOS
+	// 複数のAppendをまとめてfsyncし、fsyncが終わってからAppendを返す(グループコミット)
+	SyncGroup
+	// Appendのたびにfsyncする
+	SyncAlways
+)
+
+// 設定ファイルやフラグで指定された名前をSyncPolicyにする。空の場合はSyncDefault
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "":
+		return SyncDefault, nil
+	case "os":
+		return SyncOS, nil
+	case "group":
+		return SyncGroup, nil
+	case "always":
+		return SyncAlways, nil
 	}
+	return SyncDefault, fmt.Errorf("unknown sync policy: %q", name)
 }
@@ -0,0 +1,35 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// 埋め込んだraft.Configの値はそのまま使い、0の値だけをデフォルト値で埋める
+func TestRaftConfig(t *testing.T) {
+	c := RaftConfig{}
+	c.LocalID = "0"
+	c.MaxAppendEntries = 16
+	c.BatchApplyCh = true
+	c.LeaderLeaseTimeout = 100 * time.Millisecond
+	c.HeartbeatTimeout = 200 * time.Millisecond
+
+	config, err := c.raftConfig()
+	require.NoError(t, err)
+	defaults := raft.DefaultConfig()
+	require.Equal(t, raft.ServerID("0"), config.LocalID)
+	require.Equal(t, 16, config.MaxAppendEntries)
+	require.True(t, config.BatchApplyCh)
+	require.Equal(t, 100*time.Millisecond, config.LeaderLeaseTimeout)
+	require.Equal(t, 200*time.Millisecond, config.HeartbeatTimeout)
+	require.Equal(t, defaults.ElectionTimeout, config.ElectionTimeout)
+	require.Equal(t, defaults.ProtocolVersion, config.ProtocolVersion)
+	require.Equal(t, defaults.SnapshotThreshold, config.SnapshotThreshold)
+	require.True(t, config.ShutdownOnRemove)
+
+	// 呼び出し元の設定は書き換えない
+	require.Zero(t, c.ElectionTimeout)
+}
@@ -3,11 +3,14 @@ package log
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -16,23 +19,38 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// raftで複製するログ。デフォルトのトピックと名前付きトピックの全てのパーティションが1つのraftグループとFSMを共有する。
+// パーティションはそれぞれのセグメントのディレクトリを持つが、書き込みは全て1つのリーダーの1つのraftのログを経由するので、
+// パーティションを増やしても書き込みのスループットは1つのraftグループの上限を超えない。
 type DistributedLog struct {
-	config  Config
+	config Config
+	// デフォルトのトピックのログ
 	log     *Log
+	topics  *topics
+	offsets *groupOffsets
 	raftLog *logStore
-	raft    *raft.Raft
+	fsm     *fsm
+	// 同じデータディレクトリで開き直せるように、Closeで閉じる
+	stableStore *raftboltdb.BoltStore
+	raft        *raft.Raft
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
-
+	// ファイルを作る前にraftの設定を検証する
+	config.Raft.setDefaults()
+	raftConfig, err := config.Raft.raftConfig()
+	if err != nil {
+		return nil, err
+	}
 	l := &DistributedLog{
-		config: config,
+		config:  config,
+		offsets: newGroupOffsets(),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
 
 	}
-	if err := l.setupRaft(dataDir); err != nil {
+	if err := l.setupRaft(dataDir, raftConfig); err != nil {
 		return nil, err
 	}
 	return l, nil
@@ -48,78 +66,98 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	// 名前付きトピックはtopics以下にトピックごとのディレクトリを持つ
+	l.topics, err = newTopics(filepath.Join(dataDir, "topics"), l.config)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func (l *DistributedLog) setupRaft(dataDir string) error {
+func (l *DistributedLog) setupRaft(dataDir string, config *raft.Config) error {
 	var err error
-	fsm := &fsm{log: l.log}
+	// スナップショットのハードリンクを置くディレクトリ。残っているものは前回の途中で終わったスナップショットなので消す
+	snapshotDir := filepath.Join(dataDir, "raft", "fsm")
+	if err := os.RemoveAll(snapshotDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return err
+	}
+	l.fsm = &fsm{log: l.log, topics: l.topics, offsets: l.offsets, dir: snapshotDir}
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return nil
+		return err
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
+	// raftはStoreLogsが返ったエントリは永続化されている前提なので、指定がなければAppend毎にfsyncする
+	if logConfig.Segment.Sync == SyncDefault {
+		logConfig.Segment.Sync = SyncAlways
+	}
+	// raftのログはスナップショット後にraft自身がDeleteRangeで削除するので、保持条件は適用しない
+	logConfig.Retention.MaxBytes, logConfig.Retention.MaxAge, logConfig.Retention.MinOffset = 0, 0, 0
 	l.raftLog, err = newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
 	}
 	// raftは特定のログインターフェースが必要なので下記に書く
-	stableStore, err := raftboltdb.NewBoltStore(
+	l.stableStore, err = raftboltdb.NewBoltStore(
 		filepath.Join(dataDir, "raft", "stable"),
 	)
 	if err != nil {
 		return err
 	}
-	retain := 1
 	snapshotStore, err := raft.NewFileSnapshotStore(
 		filepath.Join(dataDir, "raft"),
-		retain,
+		l.config.Raft.SnapshotRetain,
 		os.Stderr,
 	)
 	if err != nil {
 		return err
 	}
-	maxPool := 5
-	timeout := 10 * time.Second
 	transport := raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
-		maxPool,
-		timeout,
+		l.config.Raft.MaxPool,
+		l.config.Raft.TransportTimeout,
 		os.Stderr,
 	)
 
-	config := raft.DefaultConfig()
-	config.LocalID = l.config.Raft.LocalID
-	if l.config.Raft.HeartbeatTimeout != 0 {
-		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
-	}
-	if l.config.Raft.ElectionTimeout != 0 {
-		config.ElectionTimeout = l.config.Raft.ElectionTimeout
-	}
-	if l.config.Raft.LeaderLeaseTimeout != 0 {
-		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
-	}
-	if l.config.Raft.CommitTimeout != 0 {
-		config.CommitTimeout = l.config.Raft.CommitTimeout
-	}
-
-	l.raft, err = raft.NewRaft(
-		config,
-		fsm,
+	hasState, err := raft.HasExistingState(
 		l.raftLog,
-		stableStore,
+		l.stableStore,
 		snapshotStore,
-		transport,
 	)
 	if err != nil {
 		return err
 	}
+	// fsmはレコードが持つraftのインデックスと書き出した状態から適用済みのエントリを読み飛ばすので、再起動してもローカルのログをそのまま使う。
+	// 状態を書き出す前のデータディレクトリは、どこまで適用したか分からないので空にしてraftに作り直させる
+	persisted, err := l.fsm.openState(dataDir)
+	if err != nil {
+		return err
+	}
+	if !persisted {
+		if hasState {
+			if err := l.log.Reset(); err != nil {
+				return err
+			}
+			if err := l.topics.reset(); err != nil {
+				return err
+			}
+		}
+		if err := l.fsm.saveState(0); err != nil {
+			return err
+		}
+	}
 
-	hasState, err := raft.HasExistingState(
+	l.raft, err = raft.NewRaft(
+		config,
+		l.fsm,
 		l.raftLog,
-		stableStore,
+		l.stableStore,
 		snapshotStore,
+		transport,
 	)
 	if err != nil {
 		return err
@@ -131,22 +169,113 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 				Address: transport.LocalAddr(),
 			}},
 		}
-		err = l.raft.BootstrapCluster(config).Error()
+		if err := l.raft.BootstrapCluster(config).Error(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 // Logと同じインターフェースを持たせる
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	return l.append("", 0, record)
+}
+
+// 複数のレコードを1つのraftのエントリにまとめて追加し、それぞれのオフセットを返す。
+func (l *DistributedLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	return l.appendBatch("", 0, records)
+}
+
+// レコードにはraftに渡す前にタイムスタンプを付与し、全てのサーバで同じタイムスタンプを持つようにする。
+func (l *DistributedLog) append(topic string, partition uint32, record *api.Record) (uint64, error) {
+	record.Timestamp = time.Now().UnixNano()
 	res, err := l.apply(
 		AppendRequestType,
-		&api.ProduceRequest{Record: record},
+		&api.ProduceRequest{Record: record, Topic: topic, Partition: partition},
 	)
 	if err != nil {
 		return 0, err
 	}
 	return res.(*api.ProduceResponse).Offset, nil
+}
 
+func (l *DistributedLog) appendBatch(topic string, partition uint32, records []*api.Record) ([]uint64, error) {
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		record.Timestamp = now
+	}
+	res, err := l.apply(
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{Records: records, Topic: topic, Partition: partition},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.ProduceBatchResponse).Offsets, nil
+}
+
+// 名前付きトピックのパーティションを返す。存在しない場合はErrUnknownTopicかErrUnknownPartitionを返す。
+func (l *DistributedLog) Topic(name string, partition uint32) (*Topic, error) {
+	if _, err := l.topics.get(name, partition); err != nil {
+		return nil, err
+	}
+	return &Topic{name: name, partition: partition, dlog: l}, nil
+}
+
+// トピックのパーティション数を返す。デフォルトのトピックは1つのパーティションのみを持つ。
+func (l *DistributedLog) Partitions(name string) (uint32, error) {
+	if name == "" {
+		return 1, nil
+	}
+	return l.topics.partitions(name)
+}
+
+// トピックの作成はraftを通して全てのサーバに適用する。partitionsが0の場合は1つのパーティションを持つ。
+func (l *DistributedLog) CreateTopic(name string, partitions uint32) error {
+	if err := validateTopicName(name); err != nil {
+		return err
+	}
+	_, err := l.apply(
+		CreateTopicRequestType,
+		&api.CreateTopicRequest{Name: name, Partitions: partitions},
+	)
+	return err
+}
+
+func (l *DistributedLog) DeleteTopic(name string) error {
+	_, err := l.apply(
+		DeleteTopicRequestType,
+		&api.DeleteTopicRequest{Name: name},
+	)
+	return err
+}
+
+// 名前付きトピックの一覧をローカルから返す。
+func (l *DistributedLog) ListTopics() ([]string, error) {
+	return l.topics.list(), nil
+}
+
+// コンシューマグループが次に読み出すオフセットをraftを通してコミットする。
+func (l *DistributedLog) CommitOffset(topic string, partition uint32, group string, offset uint64) error {
+	_, err := l.apply(
+		CommitOffsetRequestType,
+		&api.CommitOffsetRequest{
+			Topic:     topic,
+			Partition: partition,
+			Group:     group,
+			Offset:    offset,
+		},
+	)
+	return err
+}
+
+// コンシューマグループがコミットしたオフセットを返す。Readと同じく緩やかな一貫性でローカルから読み出す。
+func (l *DistributedLog) FetchOffset(topic string, partition uint32, group string) (uint64, error) {
+	off, ok := l.offsets.get(topic, partition, group)
+	if !ok {
+		return 0, api.ErrUnknownGroup{Group: group}
+	}
+	return off, nil
 }
 
 // raftのAPIを内包し、リクエストを適用し、そのレスポンスを返す。
@@ -164,10 +293,9 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interfac
 	if err != nil {
 		return nil, err
 	}
-	timeout := 10 * time.Second
-	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	future := l.raft.Apply(buf.Bytes(), l.config.Raft.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, l.leaderError(err)
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
@@ -180,7 +308,71 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interfac
 func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
-func (l *DistributedLog) Join(id, addr string) error {
+
+// ローカルのログが保持している最も古いオフセットを返す。
+func (l *DistributedLog) LowerOffset() (uint64, error) {
+	return l.log.LowerOffset()
+}
+
+// タイムスタンプ(UnixNano)がts以上の最初のレコードのオフセットをローカルのログから求める。
+func (l *DistributedLog) OffsetForTime(ts int64) (uint64, error) {
+	return l.log.OffsetForTime(ts)
+}
+
+// levelで指定された一貫性で読み出せる状態になるまで待つ。LOCALの場合はすぐに返る。
+// LEADERとLINEARIZABLEはリーダーでのみ読み出せるので、フォロワーではリーダーのアドレスを含めたErrNotLeaderを返す。
+// フォロワーでLINEARIZABLEに読み出すには、リーダーのReadIndexで得たインデックスをWaitAppliedで待つ。
+func (l *DistributedLog) ReadBarrier(level api.Consistency) error {
+	if level == api.Consistency_LOCAL {
+		return nil
+	}
+	if err := l.raft.VerifyLeader().Error(); err != nil {
+		return api.ErrNotLeader{Leader: string(l.raft.Leader())}
+	}
+	if level == api.Consistency_LEADER {
+		return nil
+	}
+	// Barrierが返った時点で、それまでにコミットされたエントリは全てFSMに適用されている
+	if err := l.raft.Barrier(l.config.Raft.ReadTimeout).Error(); err != nil {
+		return l.leaderError(err)
+	}
+	return nil
+}
+
+// リーダーであることを確認し、FSMに適用済みの最後のエントリのインデックスを返す(read index)。
+// raftはno-opや設定変更のエントリをFSMに渡さないので、raftのコミットインデックスではなくFSMが適用したインデックスを返す。
+func (l *DistributedLog) ReadIndex() (uint64, error) {
+	if err := l.ReadBarrier(api.Consistency_LINEARIZABLE); err != nil {
+		return 0, err
+	}
+	index, _ := l.fsm.appliedIndex()
+	return index, nil
+}
+
+// ローカルのFSMにindexまでのエントリが適用されるのを待つ。
+func (l *DistributedLog) WaitApplied(index uint64) error {
+	timeoutc := time.After(l.config.Raft.ReadTimeout)
+	for {
+		applied, appliedc := l.fsm.appliedIndex()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for index %d to be applied", index)
+		case <-appliedc:
+		}
+	}
+}
+
+// ローカルのログに次にレコードが適用された時に閉じられるチャネルを返す。
+func (l *DistributedLog) Appended() <-chan struct{} {
+	return l.log.Appended()
+}
+
+// サーバをクラスタに追加する。voterがfalseの場合は、リーダーの選出とコミットに参加しない読み出し専用のレプリカとして追加する。
+// すでに同じIDとアドレスで参加している場合は、投票権を変えない。投票権の変更にはSetVoterを使う
+func (l *DistributedLog) Join(id, addr string, voter bool) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
@@ -200,16 +392,83 @@ func (l *DistributedLog) Join(id, addr string) error {
 			}
 		}
 	}
-	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
-	if err := addFuture.Error(); err != nil {
-		return err
+	addFuture := l.raft.AddVoter
+	if !voter {
+		addFuture = l.raft.AddNonvoter
+	}
+	if err := addFuture(serverID, serverAddr, 0, 0).Error(); err != nil {
+		return l.leaderError(err)
 	}
 	return nil
 
 }
+
+// 参加しているサーバを投票者に昇格、または投票権を持たないレプリカに降格する。
+func (l *DistributedLog) SetVoter(id string, voter bool) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != raft.ServerID(id) {
+			continue
+		}
+		if (srv.Suffrage == raft.Voter) == voter {
+			return nil
+		}
+		if voter {
+			// 投票権を持たないサーバに対するAddVoterは昇格になる
+			return l.leaderError(l.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error())
+		}
+		return l.leaderError(l.raft.DemoteVoter(srv.ID, 0, 0).Error())
+	}
+	return api.ErrUnknownServer{ID: id}
+}
 func (l *DistributedLog) Leave(id string) error {
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
-	return removeFuture.Error()
+	return l.leaderError(removeFuture.Error())
+}
+
+// 呼び出し側がリーダーに転送できるように、raft.ErrNotLeaderをリーダーのアドレスを含めたErrNotLeaderに置き換える
+func (l *DistributedLog) leaderError(err error) error {
+	if err == raft.ErrNotLeader {
+		return api.ErrNotLeader{Leader: string(l.raft.Leader())}
+	}
+	return err
+}
+
+// raftの設定からクラスタのサーバの一覧を返す。サーバのアドレスはraftに参加した時のアドレスで、エージェントではRPCのアドレスになる
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leaderID := l.raft.LeaderWithID()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: server.ID == leaderID,
+			IsVoter:  server.Suffrage == raft.Voter,
+		})
+	}
+	return servers, nil
+}
+
+// 現在のリーダーのサーバIDとアドレスを返す。リーダーがいない場合は空になる
+func (l *DistributedLog) Leader() (id, addr string) {
+	leaderAddr, leaderID := l.raft.LeaderWithID()
+	return string(leaderID), string(leaderAddr)
+}
+
+// リーダーの場合は他の投票者にリーダーを引き継ぐ。停止する前に呼ぶと、選挙を待たずに書き込みを続けられる。
+// リーダーでない場合は何もしない
+func (l *DistributedLog) TransferLeadership() error {
+	if l.raft.State() != raft.Leader {
+		return nil
+	}
+	return l.raft.LeadershipTransfer().Error()
 }
 
 // リーダーが選出されるまでまつ
@@ -239,6 +498,12 @@ func (l *DistributedLog) Close() error {
 	if err := l.raftLog.Close(); err != nil {
 		return err
 	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	if err := l.topics.Close(); err != nil {
+		return err
+	}
 	//ローカルログを閉じる
 	return l.log.Close()
 }
@@ -246,73 +511,538 @@ func (l *DistributedLog) Close() error {
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
-	log *Log
+	log     *Log
+	topics  *topics
+	offsets *groupOffsets
+	// スナップショットごとにセグメントのハードリンクを置くディレクトリを作る
+	dir string
+
+	// 最後に適用したエントリのインデックス。appliedcは次に適用された時に閉じられる
+	mu       sync.Mutex
+	applied  uint64
+	appliedc chan struct{}
+
+	// 以下はraftがApplyとRestoreを呼ぶgoroutineからのみ使う
+	// ログ以外の状態を書き出すディレクトリ。空の場合は永続化しない
+	stateDir string
+	// ログ以外の状態を最後に変更したエントリのインデックス。これ以前のコミットとトピックの作成と削除は適用済み
+	stateIndex uint64
+	// トピックを作成したエントリのインデックス。これより前の追加のエントリは、削除された同じ名前のトピックのもの
+	created map[string]uint64
+	// ログごとに最後に追加したレコードのraftのインデックス。初めて使う時にログの末尾のレコードから読み込む
+	lastIndexes map[*Log]uint64
+}
+
+const fsmStateFile = "fsm_state"
+
+// ログ以外のFSMの状態。コミットとトピックの作成と削除を適用する度に書き出す
+type fsmState struct {
+	Index   uint64            `json:"index"`
+	Offsets *groupOffsets     `json:"offsets"`
+	Created map[string]uint64 `json:"created,omitempty"`
+}
+
+// dirに書き出したログ以外の状態を読み込み、以降の適用で書き出す。書き出した状態がなかった場合はfalseを返す。
+func (f *fsm) openState(dir string) (bool, error) {
+	f.stateDir = dir
+	p, err := os.ReadFile(filepath.Join(dir, fsmStateFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	state := fsmState{Offsets: f.offsets}
+	if err := json.Unmarshal(p, &state); err != nil {
+		return false, err
+	}
+	f.stateIndex, f.created = state.Index, state.Created
+	return true, nil
+}
+
+// ログ以外の状態をindexのエントリまで適用したものとして書き出す。途中で終了しても前の内容が残るように、別のファイルに書いてから置き換える
+func (f *fsm) saveState(index uint64) error {
+	f.stateIndex = index
+	if f.stateDir == "" {
+		return nil
+	}
+	p, err := json.Marshal(fsmState{Index: index, Offsets: f.offsets, Created: f.created})
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(f.stateDir, fsmStateFile)
+	if err := writeFile(name+".tmp", bytes.NewReader(p), uint64(len(p))); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
 }
+
+func (f *fsm) appliedIndex() (uint64, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.appliedc == nil {
+		f.appliedc = make(chan struct{})
+	}
+	return f.applied, f.appliedc
+}
+
+// 適用済みのインデックスを更新し、待っている読み出し側に知らせる。再起動後はraftが適用し直すまで0になる
+func (f *fsm) setApplied(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = index
+	if f.appliedc != nil {
+		close(f.appliedc)
+		f.appliedc = nil
+	}
+}
+
+// logに最後に追加したレコードのraftのインデックスを返す。レコードがない場合は0を返す
+func (f *fsm) lastIndex(log *Log) (uint64, error) {
+	if index, ok := f.lastIndexes[log]; ok {
+		return index, nil
+	}
+	log.mu.RLock()
+	empty := log.empty()
+	off, err := log.highestOffset()
+	log.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	var index uint64
+	if !empty {
+		record, err := log.Read(off)
+		if err != nil {
+			return 0, err
+		}
+		index = record.RaftIndex
+	}
+	if f.lastIndexes == nil {
+		f.lastIndexes = make(map[*Log]uint64)
+	}
+	f.lastIndexes[log] = index
+	return index, nil
+}
+
+// indexの追加のエントリのうちlogに追加済みのレコードのオフセットを返す。
+// レコードを追加してから異常終了すると、raftは再起動後に同じエントリをもう1度適用するので、ログの末尾のレコードが持つraftのインデックスと比べて追加し直さない。
+// バッチの途中で異常終了した場合は、追加済みのレコードのオフセットだけを返す。
+// doneがtrueの場合は、ログがより後のエントリを適用済みか、エントリが削除された同じ名前のトピックのもの
+func (f *fsm) appendedOffsets(log *Log, topic string, index uint64) (offsets []uint64, done bool, err error) {
+	if index < f.created[topic] {
+		return nil, true, nil
+	}
+	last, err := f.lastIndex(log)
+	if err != nil {
+		return nil, false, err
+	}
+	if last != index {
+		return nil, last > index, nil
+	}
+	lowest, err := log.LowerOffset()
+	if err != nil {
+		return nil, false, err
+	}
+	off, err := log.HighestOffset()
+	if err != nil {
+		return nil, false, err
+	}
+	for {
+		record, err := log.Read(off)
+		if err != nil {
+			return nil, false, err
+		}
+		if record.RaftIndex != index {
+			break
+		}
+		offsets = append([]uint64{off}, offsets...)
+		if off == lowest {
+			break
+		}
+		off--
+	}
+	return offsets, false, nil
+}
+
 type RequestType uint8
 
 const (
-	AppendRequestType = 0
+	AppendRequestType       = 0
+	AppendBatchRequestType  = 1
+	CommitOffsetRequestType = 2
+	CreateTopicRequestType  = 3
+	DeleteTopicRequestType  = 4
 )
 
+// トピックのパーティションとコンシューマグループごとにコミットされたオフセット。raftのエントリを適用して更新し、スナップショットに含める
+type groupOffsets struct {
+	mu      sync.RWMutex
+	offsets map[string]map[uint32]map[string]uint64
+}
+
+func newGroupOffsets() *groupOffsets {
+	return &groupOffsets{offsets: make(map[string]map[uint32]map[string]uint64)}
+}
+
+func (g *groupOffsets) get(topic string, partition uint32, group string) (uint64, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	off, ok := g.offsets[topic][partition][group]
+	return off, ok
+}
+
+func (g *groupOffsets) set(topic string, partition uint32, group string, offset uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.offsets[topic] == nil {
+		g.offsets[topic] = make(map[uint32]map[string]uint64)
+	}
+	if g.offsets[topic][partition] == nil {
+		g.offsets[topic][partition] = make(map[string]uint64)
+	}
+	g.offsets[topic][partition][group] = offset
+}
+
+func (g *groupOffsets) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offsets = make(map[string]map[uint32]map[string]uint64)
+}
+
+// トピックを削除した時に、そのトピックのコミットも削除する
+func (g *groupOffsets) deleteTopic(topic string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.offsets, topic)
+}
+
+func (g *groupOffsets) MarshalJSON() ([]byte, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return json.Marshal(g.offsets)
+}
+
+func (g *groupOffsets) UnmarshalJSON(b []byte) error {
+	offsets := make(map[string]map[uint32]map[string]uint64)
+	if err := json.Unmarshal(b, &offsets); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offsets = offsets
+	return nil
+}
+
 // FSMのApplyメソッドでリクエストを読み込んで適用する時はリクエスト種別はリクエストを意識して、それをどのように処理するのかを示す
+// raftは再起動するとスナップショット以降のエントリを適用し直すので、適用済みのエントリは読み飛ばす。
+// 追加のエントリはログのレコードが持つraftのインデックスと比べ、それ以外のエントリは書き出した状態のインデックスと比べる
 func (l *fsm) Apply(record *raft.Log) interface{} {
-	buf := record.Data
+	res := l.apply(record.Index, record.Data)
+	l.setApplied(record.Index)
+	return res
+}
+
+func (l *fsm) apply(index uint64, buf []byte) interface{} {
 	reqType := RequestType(buf[0])
 	switch reqType {
 	case AppendRequestType:
-		return l.applyAppend(buf[1:])
+		return l.applyAppend(index, buf[1:])
+	case AppendBatchRequestType:
+		return l.applyAppendBatch(index, buf[1:])
+	}
+	if index <= l.stateIndex {
+		return nil
+	}
+	switch reqType {
+	case CommitOffsetRequestType:
+		return l.applyCommitOffset(index, buf[1:])
+	case CreateTopicRequestType:
+		return l.applyCreateTopic(index, buf[1:])
+	case DeleteTopicRequestType:
+		return l.applyDeleteTopic(index, buf[1:])
 	}
 	return nil
 }
 
+// トピック名とパーティションからログを返す。空の場合はデフォルトのトピックで、パーティションは0のみ
+func (l *fsm) topicLog(topic string, partition uint32) (*Log, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, api.ErrUnknownPartition{Topic: topic, Partition: partition}
+		}
+		return l.log, nil
+	}
+	return l.topics.get(topic, partition)
+}
+
 // ↓ここl担っている？
-func (l *fsm) applyAppend(b []byte) interface{} {
+func (l *fsm) applyAppend(index uint64, b []byte) interface{} {
 	var req api.ProduceRequest
 	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
 	}
-	offset, err := l.log.Append(req.Record)
+	log, err := l.topicLog(req.Topic, req.Partition)
 	if err != nil {
 		return err
 	}
+	appended, done, err := l.appendedOffsets(log, req.Topic, index)
+	if err != nil || done {
+		return err
+	}
+	if len(appended) > 0 {
+		return &api.ProduceResponse{Offset: appended[0]}
+	}
+	req.Record.RaftIndex = index
+	offset, err := log.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	l.lastIndexes[log] = index
 	return &api.ProduceResponse{Offset: offset}
 }
 
+func (l *fsm) applyAppendBatch(index uint64, b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	log, err := l.topicLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	offsets, done, err := l.appendedOffsets(log, req.Topic, index)
+	if err != nil || done {
+		return err
+	}
+	// バッチの途中で異常終了した場合は残りのレコードだけを追加する
+	records := req.Records[len(offsets):]
+	if len(records) > 0 {
+		for _, record := range records {
+			record.RaftIndex = index
+		}
+		appended, err := log.AppendBatch(records)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, appended...)
+		l.lastIndexes[log] = index
+	}
+	return &api.ProduceBatchResponse{Offsets: offsets}
+}
+
+func (l *fsm) applyCommitOffset(index uint64, b []byte) interface{} {
+	var req api.CommitOffsetRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	// 検証を通らなかったエントリがログに残っていても、空のグループ名は記録しない
+	if req.Group == "" {
+		return api.ErrInvalidGroupName{Group: req.Group}
+	}
+	if _, err := l.topicLog(req.Topic, req.Partition); err != nil {
+		return err
+	}
+	l.offsets.set(req.Topic, req.Partition, req.Group, req.Offset)
+	if err := l.saveState(index); err != nil {
+		return err
+	}
+	return &api.CommitOffsetResponse{}
+}
+
+func (l *fsm) applyCreateTopic(index uint64, b []byte) interface{} {
+	var req api.CreateTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if err := validateTopicName(req.Name); err != nil {
+		return err
+	}
+	_, err = l.topics.partitions(req.Name)
+	switch exists := err == nil; {
+	case exists && l.created[req.Name] == index:
+		// 作成した後、状態を書き出す前に異常終了していた
+	case exists:
+		return api.ErrTopicExists{Topic: req.Name}
+	default:
+		// 作成してから状態を書き出すまでに異常終了しても、削除された同じ名前のトピックのエントリが新しいトピックに追加されないように、
+		// 作成する前に作成したエントリのインデックスを書き出す
+		if l.created == nil {
+			l.created = make(map[string]uint64)
+		}
+		l.created[req.Name] = index
+		if err := l.saveState(l.stateIndex); err != nil {
+			return err
+		}
+		if err := l.topics.create(req.Name, req.Partitions); err != nil {
+			return err
+		}
+	}
+	if err := l.saveState(index); err != nil {
+		return err
+	}
+	return &api.CreateTopicResponse{}
+}
+
+func (l *fsm) applyDeleteTopic(index uint64, b []byte) interface{} {
+	var req api.DeleteTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	err = l.topics.delete(req.Name)
+	if _, ok := err.(api.ErrUnknownTopic); err != nil && !ok {
+		return err
+	}
+	// 削除した後、状態を書き出す前に異常終了していた場合もトピックのコミットを消す
+	l.offsets.deleteTopic(req.Name)
+	delete(l.created, req.Name)
+	l.lastIndexes = nil
+	if err := l.saveState(index); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return &api.DeleteTopicResponse{}
+}
+
+// スナップショットのメタデータのフレームの中身
+type snapshotMeta struct {
+	// 先頭のフレームのみが持つ。Topicsはトピック名ごとのパーティション数
+	Offsets *groupOffsets     `json:"offsets,omitempty"`
+	Topics  map[string]uint32 `json:"topics,omitempty"`
+	// スナップショットを取った時点でFSMに適用済みの最後のエントリのインデックス
+	Applied uint64 `json:"applied,omitempty"`
+	// 名前付きトピックのパーティションのフレームの前に置き、後続のフレームがどのパーティションのものかを示す
+	Topic     string `json:"topic,omitempty"`
+	Partition uint32 `json:"partition,omitempty"`
+	// ログのセグメントの一覧。後ろにセグメントごとのストア、インデックス、時刻のインデックスのファイルがそのまま続く
+	Segments []SegmentInfo `json:"segments,omitempty"`
+}
+
+// スナップショットはメタデータのフレームと、セグメントのファイルで構成される。
+// 先頭にコミットされたオフセットとトピックの一覧、次にデフォルトのトピックのログ、その後にパーティションごとのログが続く。
+// ログはセグメントの一覧のフレームと、その後に続くセグメントのファイルの中身からなる。
+// ファイルはここではハードリンクかコピーを作るだけで、中身を書き出すのはPersistで行う。
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	names := f.topics.list()
+	topics := make(map[string]uint32, len(names))
+	for _, name := range names {
+		n, err := f.topics.partitions(name)
+		if err != nil {
+			return nil, err
+		}
+		topics[name] = n
+	}
+	applied, _ := f.appliedIndex()
+	meta, err := json.Marshal(snapshotMeta{Offsets: f.offsets, Topics: topics, Applied: applied})
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(f.dir, "snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{dir: dir, header: encodeFrame(frameVersionMeta, meta)}
+	if err := snap.addLog(f.log, "", 0); err != nil {
+		snap.Release()
+		return nil, err
+	}
+	for _, name := range names {
+		for partition := uint32(0); partition < topics[name]; partition++ {
+			log, err := f.topics.get(name, partition)
+			if err == nil {
+				err = snap.addLog(log, name, partition)
+			}
+			if err != nil {
+				snap.Release()
+				return nil, err
+			}
+		}
+	}
+	return snap, nil
 }
 
 // ログをリセットし、その初期オフセットをスナップショットからう読み取った最初のレコードのオフセットに設定し、ログのオフセットが一致するようにする。
+// 名前付きトピックは全て削除してから、スナップショットにあるトピックを作り直す。
+// セグメントの一覧を持つスナップショットは、レコードを追加し直さずにセグメントのファイルをそのまま置く。
+// レコードのフレームが続く場合は以前の形式のスナップショットとして、レコードを追加し直す。
 func (f *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
-	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
+	// スナップショットに含まれないトピックとコミットが残らないように、フレームの形式によらず先に消しておく
+	if err := f.topics.reset(); err != nil {
+		return err
+	}
+	f.offsets.reset()
+	f.created = nil
+	f.lastIndexes = nil
+	// 適用済みのインデックスはスナップショットの先頭のフレームから読み取る。以前の形式のスナップショットは持たないので0にする
+	f.setApplied(0)
+	if err := f.saveState(0); err != nil {
+		return err
+	}
+	log := f.log
+	first := true
+	for {
+		frame, p, err := readFrame(r)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
-			return err
+		if frameVersion(frame) == frameVersionMeta {
+			meta := snapshotMeta{Offsets: f.offsets}
+			if err = json.Unmarshal(p, &meta); err != nil {
+				return err
+			}
+			if meta.Segments != nil {
+				log := f.log
+				if meta.Topic != "" {
+					if log, err = f.topics.get(meta.Topic, meta.Partition); err != nil {
+						return err
+					}
+				}
+				if err := log.install(meta.Segments, r); err != nil {
+					return err
+				}
+				continue
+			}
+			if meta.Topic == "" {
+				// 先頭のフレーム
+				f.setApplied(meta.Applied)
+				if err := f.saveState(meta.Applied); err != nil {
+					return err
+				}
+				for name, partitions := range meta.Topics {
+					if err := f.topics.create(name, partitions); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if log, err = f.topics.get(meta.Topic, meta.Partition); err != nil {
+				return err
+			}
+			first = true
+			continue
 		}
 		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+		if err = proto.Unmarshal(p, record); err != nil {
 			return err
 		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		if first {
+			first = false
+			log.Config.Segment.InitialOffset = record.Offset
+			if err := log.Reset(); err != nil {
 				return err
 			}
 		}
-		if _, err = f.log.Append(record); err != nil {
+		if _, err = log.Append(record); err != nil {
 			return err
 		}
-		buf.Reset()
 	}
 	return nil
 }
@@ -320,17 +1050,63 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 type snapshot struct {
-	reader io.Reader
+	// セグメントのハードリンクとコピーを置くディレクトリ。Releaseで削除する
+	dir    string
+	header []byte
+	logs   []snapshotLog
 }
 
+type snapshotLog struct {
+	meta  []byte
+	files []snapshotFile
+}
+
+// ログのセグメントのファイルをスナップショットのディレクトリに置き、書き出すログに加える。
+func (s *snapshot) addLog(log *Log, topic string, partition uint32) error {
+	segments, files, err := log.snapshot(filepath.Join(s.dir, strconv.Itoa(len(s.logs))))
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(snapshotMeta{Topic: topic, Partition: partition, Segments: segments})
+	if err != nil {
+		return err
+	}
+	s.logs = append(s.logs, snapshotLog{
+		meta:  encodeFrame(frameVersionMeta, meta),
+		files: files,
+	})
+	return nil
+}
+
+// メタデータのフレームとセグメントのファイルの中身を順にsinkへ書き出す。
+// ファイルストアのsinkはそのままディスクに、遅れているフォロワーへはトランスポートでストリームとして送られる。
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	err := s.persist(sink)
+	if err != nil {
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
-func (s *snapshot) Release() {}
+
+func (s *snapshot) persist(w io.Writer) error {
+	if _, err := w.Write(s.header); err != nil {
+		return err
+	}
+	for _, log := range s.logs {
+		if _, err := w.Write(log.meta); err != nil {
+			return err
+		}
+		if err := writeSnapshotFiles(w, log.files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) Release() {
+	_ = os.RemoveAll(s.dir)
+}
 
 var _ raft.LogStore = (*logStore)(nil)
 
@@ -348,17 +1124,31 @@ func newLogStore(dir string, c Config) (*logStore, error) {
 	return &logStore{Log: log}, nil
 }
 
+// raftの約束に従い、エントリがない場合は0を返す。
 func (l *logStore) FirstIndex() (uint64, error) {
-	return l.LowerOffset()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.empty() {
+		return 0, nil
+	}
+	return l.segments[0].baseOffset, nil
 }
 
 func (l *logStore) LastIndex() (uint64, error) {
-	off, err := l.HighestOffset()
-	return off, err
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.empty() {
+		return 0, nil
+	}
+	return l.highestOffset()
 }
 
+// エントリがない場合は、raftがスナップショットを送るように判断できるようにraft.ErrLogNotFoundを返す。
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return raft.ErrLogNotFound
+	}
 	if err != nil {
 		return err
 	}
@@ -374,20 +1164,63 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 	return l.StoreLogs([]*raft.Log{record})
 }
 
+// raftから渡されたエントリをまとめて追加し、永続化を1回で済ませる。
+// ログのオフセットはエントリのインデックスと一致させる必要があるので、最初のエントリが次のオフセットと異なる場合はログを合わせる。
 func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := l.reposition(records[0].Index); err != nil {
+		return err
+	}
+	batch := make([]*api.Record, 0, len(records))
 	for _, record := range records {
-		if _, err := l.Append(&api.Record{
+		batch = append(batch, &api.Record{
 			Value: record.Data,
 			Term:  record.Term,
 			Type:  uint32(record.Type),
-		}); err != nil {
-			return err
-		}
+		})
+	}
+	_, err := l.AppendBatch(batch)
+	return err
+}
+
+// 次に書き込むオフセットをindexにする。
+// indexが先にある場合は、間のエントリがスナップショットに置き換えられたので、それまでのエントリを全て削除する。
+// indexが手前にある場合は、食い違ったエントリを削除する。
+func (l *logStore) reposition(index uint64) error {
+	l.mu.RLock()
+	next := l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	switch {
+	case index > next:
+		return l.Truncate(index - 1)
+	case index < next:
+		return l.TruncateFrom(index)
 	}
 	return nil
 }
+
+// min以上max以下のエントリを削除する。
+// raftが削除するのはスナップショットに含まれた先頭のエントリか、リーダーと食い違った末尾のエントリなので、途中のエントリだけを削除することはできない。
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	switch {
+	case first == 0 || min > max:
+		return nil
+	case min <= first:
+		return l.Truncate(max)
+	case max >= last:
+		return l.TruncateFrom(min)
+	}
+	return fmt.Errorf("cannot delete range [%d, %d] inside log [%d, %d]", min, max, first, last)
 }
 
 var _ raft.StreamLayer = (*StreamLayer)(nil)
@@ -47,7 +47,7 @@ func TestMultipleNodes(t *testing.T) {
 		l, err := log.NewDistributedLog(dataDir, config)
 		require.NoError(t, err)
 		if i != 0 {
-			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String())
+			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), true)
 			require.NoError(t, err)
 		} else {
 			err = l.WaitForLeader(3 * time.Second)
@@ -79,12 +79,170 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	// バッチは1つのraftのエントリとして複製される
+	batch := []*api.Record{
+		{Value: []byte("batch first")},
+		{Value: []byte("batch second")},
+	}
+	offs, err := logs[0].AppendBatch(batch)
+	require.NoError(t, err)
+	require.Len(t, offs, len(batch))
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			for i, off := range offs {
+				got, err := logs[j].Read(off)
+				if err != nil || !reflect.DeepEqual(got.Value, batch[i].Value) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// キーとヘッダーもraftを経由して全てのノードに複製される
+	headers := map[string][]byte{"trace-id": []byte("abc")}
+	off, err := logs[0].Append(&api.Record{
+		Value:   []byte("with headers"),
+		Key:     []byte("user-1"),
+		Headers: headers,
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			got, err := logs[j].Read(off)
+			if err != nil || !reflect.DeepEqual(got.Headers, headers) || string(got.Key) != "user-1" {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// タイムスタンプはリーダーが付与するので、全てのノードで同じになる
+	first, err := logs[0].Read(offs[0])
+	require.NoError(t, err)
+	require.NotZero(t, first.Timestamp)
+	for j := 1; j < nodeCount; j++ {
+		got, err := logs[j].Read(offs[0])
+		require.NoError(t, err)
+		require.Equal(t, first.Timestamp, got.Timestamp)
+		off, err := logs[j].OffsetForTime(first.Timestamp)
+		require.NoError(t, err)
+		require.Equal(t, offs[0], off)
+	}
+
+	// リーダーは全ての一貫性で読み出せ、フォロワーはリーダーのアドレスを返す
+	for _, level := range []api.Consistency{
+		api.Consistency_LOCAL,
+		api.Consistency_LEADER,
+		api.Consistency_LINEARIZABLE,
+	} {
+		require.NoError(t, logs[0].ReadBarrier(level))
+	}
+	require.NoError(t, logs[1].ReadBarrier(api.Consistency_LOCAL))
+	leader := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	for _, level := range []api.Consistency{
+		api.Consistency_LEADER,
+		api.Consistency_LINEARIZABLE,
+	} {
+		err = logs[1].ReadBarrier(level)
+		require.Equal(t, api.ErrNotLeader{Leader: leader}, err)
+	}
+
+	// フォロワーはリーダーのReadIndexで得たインデックスまで適用されるのを待てば、直前の書き込みを読み出せる
+	off, err = logs[0].Append(&api.Record{Value: []byte("read index")})
+	require.NoError(t, err)
+	index, err := logs[0].ReadIndex()
+	require.NoError(t, err)
+	require.NoError(t, logs[1].WaitApplied(index))
+	got, err := logs[1].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("read index"), got.Value)
+	_, err = logs[1].ReadIndex()
+	require.Equal(t, api.ErrNotLeader{Leader: leader}, err)
+
+	// フォロワーへの書き込みはリーダーのアドレスを返す
+	_, err = logs[1].Append(&api.Record{Value: []byte("follower")})
+	require.Equal(t, api.ErrNotLeader{Leader: leader}, err)
+	id, addr := logs[1].Leader()
+	require.Equal(t, "0", id)
+	require.Equal(t, leader, addr)
+
+	// コミットしたオフセットは全てのノードに複製される
+	_, err = logs[0].FetchOffset("", 0, "group")
+	require.Equal(t, api.ErrUnknownGroup{Group: "group"}, err)
+	err = logs[0].CommitOffset("", 0, "group", offs[1])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			off, err := logs[j].FetchOffset("", 0, "group")
+			if err != nil || off != offs[1] {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// 名前付きトピックの作成と書き込みも全てのノードに複製される
+	err = logs[0].CreateTopic("orders", 2)
+	require.NoError(t, err)
+	require.Equal(t, api.ErrTopicExists{Topic: "orders"}, logs[0].CreateTopic("orders", 2))
+	topic, err := logs[0].Topic("orders", 1)
+	require.NoError(t, err)
+	topicOff, err := topic.Append(&api.Record{Value: []byte("order")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), topicOff)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			topic, err := logs[j].Topic("orders", 1)
+			if err != nil {
+				return false
+			}
+			got, err := topic.Read(topicOff)
+			if err != nil || !reflect.DeepEqual(got.Value, []byte("order")) {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	// パーティションごとに別のログを持つ
+	other, err := logs[0].Topic("orders", 0)
+	require.NoError(t, err)
+	_, err = other.Read(topicOff)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = logs[0].Topic("orders", 2)
+	require.Equal(t, api.ErrUnknownPartition{Topic: "orders", Partition: 2}, err)
+	err = logs[0].DeleteTopic("orders")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			if topics, _ := logs[j].ListTopics(); len(topics) != 0 {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[0].Topic("orders", 1)
+	require.Equal(t, api.ErrUnknownTopic{Topic: "orders"}, err)
+
+	// どのサーバからもリーダーを含むクラスタの構成が見える
+	for j := 0; j < nodeCount; j++ {
+		servers, err := logs[j].GetServers()
+		require.NoError(t, err)
+		require.Len(t, servers, nodeCount)
+		for i, server := range servers {
+			require.Equal(t, fmt.Sprintf("%d", i), server.Id)
+			require.Equal(t, fmt.Sprintf("127.0.0.1:%d", ports[i]), server.RpcAddr)
+			require.Equal(t, i == 0, server.IsLeader)
+			require.True(t, server.IsVoter)
+		}
+	}
+
 	// リーダーがクラスタから離脱したサーバへのレプリケーションを停止する
-	err := logs[0].Leave("1")
+	err = logs[0].Leave("1")
 	require.NoError(t, err)
 	time.Sleep(50 * time.Millisecond)
 
-	off, err := logs[0].Append(&api.Record{
+	off, err = logs[0].Append(&api.Record{
 		Value: []byte("third"),
 	})
 	require.NoError(t, err)
@@ -100,4 +258,134 @@ func TestMultipleNodes(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
+
+	// 離脱したサーバは構成から外れる
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, nodeCount-1)
+}
+
+// スナップショットでログが切り詰められた後に参加したノードには、スナップショットのセグメントのファイルが送られる
+func TestSnapshotInstall(t *testing.T) {
+	ports := dynaport.Get(2)
+	newLog := func(i int) *log.DistributedLog {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dataDir) })
+
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Segment.MaxIndexBytes = 12 * 3
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.SnapshotThreshold = 4
+		config.Raft.SnapshotInterval = 20 * time.Millisecond
+		config.Raft.TrailingLogs = 1
+		config.Raft.Bootstrap = i == 0
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		return l
+	}
+
+	leader := newLog(0)
+	require.NoError(t, leader.WaitForLeader(3*time.Second))
+	for i := 0; i < 10; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// スナップショットを取ってraftのログが切り詰められるのを待つ
+	time.Sleep(200 * time.Millisecond)
+
+	follower := newLog(1)
+	require.NoError(t, leader.Join("1", fmt.Sprintf("127.0.0.1:%d", ports[1]), true))
+	require.Eventually(t, func() bool {
+		for i := uint64(0); i < 10; i++ {
+			got, err := follower.Read(i)
+			if err != nil || string(got.Value) != fmt.Sprintf("record %d", i) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// 復元したログに続けて複製される
+	off, err := leader.Append(&api.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	require.Eventually(t, func() bool {
+		got, err := follower.Read(off)
+		return err == nil && string(got.Value) == "record 10"
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+// 同じデータディレクトリで開き直すと、raftが再適用するエントリのレコードを重複させずに作り直す
+func TestRestart(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+	open := func(bootstrap bool) *log.DistributedLog {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = bootstrap
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+
+	l := open(true)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.CommitOffset("", 0, "group", 2))
+	require.NoError(t, l.Close())
+
+	l = open(false)
+	defer l.Close()
+	// コミットされたオフセットはスナップショットがなくても残る
+	committed, err := l.FetchOffset("", 0, "group")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), committed)
+	off, err := l.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for i := uint64(0); i <= off; i++ {
+		got, err := l.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(got.Value))
+	}
+}
+
+func TestInvalidRaftConfig(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	config := log.Config{}
+	config.Raft.LocalID = "0"
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = time.Second
+	_, err = log.NewDistributedLog(dataDir, config)
+	require.Error(t, err)
+	// 検証に失敗した場合はファイルを作らない
+	entries, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
 }
@@ -0,0 +1,316 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestFSM(t *testing.T, c Config) *fsm {
+	dir, err := os.MkdirTemp("", "fsm-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "log"), 0755))
+	l, err := NewLog(filepath.Join(dir, "log"), c)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	topics, err := newTopics(filepath.Join(dir, "topics"), c)
+	require.NoError(t, err)
+	t.Cleanup(func() { topics.Close() })
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "fsm"), 0755))
+	return &fsm{log: l, topics: topics, offsets: newGroupOffsets(), dir: filepath.Join(dir, "fsm")}
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	newFSM := func() *fsm {
+		return newTestFSM(t, Config{})
+	}
+
+	src := newFSM()
+	for i := 0; i < 3; i++ {
+		_, err := src.log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	src.offsets.set("", 0, "group", 2)
+	require.NoError(t, src.topics.create("orders", 2))
+	orders, err := src.topics.get("orders", 1)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := orders.Append(&api.Record{Value: []byte("order")})
+		require.NoError(t, err)
+	}
+	src.offsets.set("orders", 1, "group", 1)
+
+	snap, err := src.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	dst := newFSM()
+	require.NoError(t, dst.Restore(io.NopCloser(&sink.Buffer)))
+
+	off, ok := dst.offsets.get("", 0, "group")
+	require.True(t, ok)
+	require.Equal(t, uint64(2), off)
+	for i := uint64(0); i < 3; i++ {
+		record, err := dst.log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+
+	// 名前付きトピックも復元される
+	require.Equal(t, []string{"orders"}, dst.topics.list())
+	n, err := dst.topics.partitions("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), n)
+	off, ok = dst.offsets.get("orders", 1, "group")
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+	orders, err = dst.topics.get("orders", 1)
+	require.NoError(t, err)
+	for i := uint64(0); i < 2; i++ {
+		record, err := orders.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("order"), record.Value)
+	}
+}
+
+// 封印済みのセグメントはハードリンクされ、スナップショットを取った後の変更の影響を受けない
+func TestFSMSnapshotLinksSealedSegments(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	src := newTestFSM(t, c)
+	for i := 0; i < 7; i++ {
+		_, err := src.log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	s, err := src.Snapshot()
+	require.NoError(t, err)
+	snap := s.(*snapshot)
+	require.Len(t, snap.logs, 1)
+	files := snap.logs[0].files
+	require.Len(t, files, 9)
+	for i, seg := range src.log.segments {
+		stored, err := os.Stat(files[i*3].path)
+		require.NoError(t, err)
+		orig, err := os.Stat(seg.storeName())
+		require.NoError(t, err)
+		// アクティブセグメントだけがコピーされる
+		require.Equal(t, seg != src.log.activeSegment, os.SameFile(stored, orig))
+	}
+
+	// スナップショットの後に追加や削除をしても、スナップショットを取った時点の内容が書き出される
+	for i := 7; i < 9; i++ {
+		_, err := src.log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, src.log.Truncate(4))
+
+	sink := &snapshotSink{}
+	require.NoError(t, s.Persist(sink))
+	s.Release()
+	_, err = os.Stat(snap.dir)
+	require.True(t, os.IsNotExist(err))
+
+	dst := newTestFSM(t, c)
+	require.NoError(t, dst.Restore(io.NopCloser(&sink.Buffer)))
+	require.Len(t, dst.log.segments, 3)
+	off, err := dst.log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	for i := uint64(0); i < 7; i++ {
+		record, err := dst.log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+	require.Empty(t, dst.log.Repairs())
+
+	// 復元したログにそのまま追加できる
+	off, err = dst.log.Append(&api.Record{Value: []byte("record 7")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+// トピックのないスナップショットを復元すると、復元先にあったトピックとコミットは消える
+func TestFSMRestoreEmptyTopics(t *testing.T) {
+	for scenario, encode := range map[string]func(t *testing.T, src *fsm) io.Reader{
+		"snapshot": func(t *testing.T, src *fsm) io.Reader {
+			snap, err := src.Snapshot()
+			require.NoError(t, err)
+			sink := &snapshotSink{}
+			require.NoError(t, snap.Persist(sink))
+			return &sink.Buffer
+		},
+		"record frames": func(t *testing.T, src *fsm) io.Reader {
+			return src.log.Reader()
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			src := newTestFSM(t, Config{})
+			_, err := src.log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+
+			dst := newTestFSM(t, Config{})
+			require.NoError(t, dst.topics.create("orders", 2))
+			dst.offsets.set("orders", 1, "group", 1)
+
+			require.NoError(t, dst.Restore(io.NopCloser(encode(t, src))))
+			require.Empty(t, dst.topics.list())
+			_, err = dst.topics.get("orders", 1)
+			require.Error(t, err)
+			_, ok := dst.offsets.get("orders", 1, "group")
+			require.False(t, ok)
+			record, err := dst.log.Read(0)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), record.Value)
+		})
+	}
+}
+
+// レコードのフレームを並べた以前の形式のスナップショットも復元できる
+func TestFSMRestoreRecordFrames(t *testing.T) {
+	src := newTestFSM(t, Config{})
+	for i := 0; i < 3; i++ {
+		_, err := src.log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	meta, err := json.Marshal(snapshotMeta{Offsets: src.offsets, Topics: map[string]uint32{}})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	buf.Write(encodeFrame(frameVersionMeta, meta))
+	_, err = io.Copy(&buf, src.log.Reader())
+	require.NoError(t, err)
+
+	dst := newTestFSM(t, Config{})
+	require.NoError(t, dst.Restore(io.NopCloser(&buf)))
+	for i := uint64(0); i < 3; i++ {
+		record, err := dst.log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
+
+// 検証を経ずにログに入ったエントリでも、空のグループ名のオフセットは記録しない
+func TestFSMApplyCommitOffsetEmptyGroup(t *testing.T) {
+	f := newTestFSM(t, Config{})
+	b, err := proto.Marshal(&api.CommitOffsetRequest{Group: "", Offset: 1})
+	require.NoError(t, err)
+	res := f.Apply(&raft.Log{Index: 1, Data: append([]byte{byte(CommitOffsetRequestType)}, b...)})
+	require.Equal(t, api.ErrInvalidGroupName{}, res)
+	_, ok := f.offsets.get("", 0, "")
+	require.False(t, ok)
+}
+
+// 再起動後にraftが適用し直すエントリのうち、適用済みのものは読み飛ばす。コミットされたオフセットは再起動しても残る
+func TestFSMApplyAfterRestart(t *testing.T) {
+	dir, err := os.MkdirTemp("", "fsm-restart-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "log"), 0755))
+	open := func() (*fsm, bool) {
+		l, err := NewLog(filepath.Join(dir, "log"), Config{})
+		require.NoError(t, err)
+		topics, err := newTopics(filepath.Join(dir, "topics"), Config{})
+		require.NoError(t, err)
+		f := &fsm{log: l, topics: topics, offsets: newGroupOffsets(), dir: dir}
+		persisted, err := f.openState(dir)
+		require.NoError(t, err)
+		return f, persisted
+	}
+	closeFSM := func(f *fsm) {
+		require.NoError(t, f.topics.Close())
+		require.NoError(t, f.log.Close())
+	}
+	entry := func(index uint64, reqType RequestType, req proto.Message) *raft.Log {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		return &raft.Log{Index: index, Data: append([]byte{byte(reqType)}, b...)}
+	}
+	records := func(values ...string) []*api.Record {
+		var records []*api.Record
+		for _, v := range values {
+			records = append(records, &api.Record{Value: []byte(v)})
+		}
+		return records
+	}
+	requireValues := func(l *Log, values ...string) {
+		off, err := l.HighestOffset()
+		require.NoError(t, err)
+		if len(values) == 0 {
+			require.True(t, l.empty())
+			return
+		}
+		require.Equal(t, uint64(len(values)-1), off)
+		for i, v := range values {
+			record, err := l.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, v, string(record.Value))
+		}
+	}
+	entries := []*raft.Log{
+		entry(1, AppendRequestType, &api.ProduceRequest{Record: &api.Record{Value: []byte("first")}}),
+		entry(2, CommitOffsetRequestType, &api.CommitOffsetRequest{Group: "group", Offset: 1}),
+		entry(3, AppendBatchRequestType, &api.ProduceBatchRequest{Records: records("second", "third")}),
+		// 削除して同じ名前で作り直したトピックに、削除する前のエントリのレコードは追加されない
+		entry(4, CreateTopicRequestType, &api.CreateTopicRequest{Name: "orders"}),
+		entry(5, AppendRequestType, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte("old order")}}),
+		entry(6, DeleteTopicRequestType, &api.DeleteTopicRequest{Name: "orders"}),
+		entry(7, CreateTopicRequestType, &api.CreateTopicRequest{Name: "orders"}),
+	}
+
+	f, persisted := open()
+	require.False(t, persisted)
+	require.NoError(t, f.saveState(0))
+	for _, e := range entries {
+		_, ok := f.Apply(e).(error)
+		require.False(t, ok)
+	}
+	// バッチを途中まで追加したところで異常終了したことにする
+	_, err = f.log.Append(&api.Record{Value: []byte("fourth"), RaftIndex: 8})
+	require.NoError(t, err)
+	closeFSM(f)
+
+	f, persisted = open()
+	defer closeFSM(f)
+	require.True(t, persisted)
+	off, ok := f.offsets.get("", 0, "group")
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+
+	for _, e := range entries {
+		_, ok := f.Apply(e).(error)
+		require.False(t, ok)
+	}
+	requireValues(f.log, "first", "second", "third", "fourth")
+	orders, err := f.topics.get("orders", 0)
+	require.NoError(t, err)
+	requireValues(orders)
+
+	// 途中まで追加したバッチは残りのレコードだけを追加する
+	res := f.Apply(entry(8, AppendBatchRequestType, &api.ProduceBatchRequest{Records: records("fourth", "fifth")}))
+	require.Equal(t, []uint64{3, 4}, res.(*api.ProduceBatchResponse).Offsets)
+	res = f.Apply(entry(9, AppendRequestType, &api.ProduceRequest{Record: &api.Record{Value: []byte("sixth")}}))
+	require.Equal(t, uint64(5), res.(*api.ProduceResponse).Offset)
+	requireValues(f.log, "first", "second", "third", "fourth", "fifth", "sixth")
+}
+
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "test" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
+
+var _ raft.SnapshotSink = (*snapshotSink)(nil)
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -85,6 +86,23 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// 相対オフセットがoff以下で最大のエントリを返す。
+// 疎なインデックスでは全てのレコードがエントリを持たないので、エントリの相対オフセットで二分探索する。
+func (i *index) Search(off uint32) (out uint32, pos uint64, err error) {
+	// 密なインデックスではoff番目のエントリがoffを指している
+	if out, pos, err := i.Read(int64(off)); err == nil && out == off {
+		return out, pos, nil
+	}
+	n := int(i.size / entWidth)
+	j := sort.Search(n, func(j int) bool {
+		return enc.Uint32(i.mmap[uint64(j)*entWidth:]) > off
+	})
+	if j == 0 {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(j - 1))
+}
+
 // 与えられたオフセットと位置をインデックスに追加する。
 func (i *index) Write(off uint32, pos uint64) error {
 	if i.isMaxed() {
@@ -98,6 +116,15 @@ func (i *index) Write(off uint32, pos uint64) error {
 
 }
 
+// 相対オフセットがoff以上のエントリを捨てる。ファイルはClose時に切り詰められる。
+func (i *index) truncate(off uint32) {
+	n := int(i.size / entWidth)
+	j := sort.Search(n, func(j int) bool {
+		return enc.Uint32(i.mmap[uint64(j)*entWidth:]) >= off
+	})
+	i.size = uint64(j) * entWidth
+}
+
 func (i *index) isMaxed() bool {
 	return uint64(len(i.mmap)) < i.size+entWidth
 }
@@ -54,4 +54,19 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 
+	// 疎なインデックスでは手前の最も近いエントリを返す
+	require.NoError(t, idx.Write(5, 50))
+	off, pos, err = idx.Search(1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+	require.Equal(t, entries[1].Pos, pos)
+	off, pos, err = idx.Search(4)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+	require.Equal(t, entries[1].Pos, pos)
+	off, pos, err = idx.Search(7)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), off)
+	require.Equal(t, uint64(50), pos)
+
 }
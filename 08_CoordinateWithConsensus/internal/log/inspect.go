@@ -0,0 +1,297 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// エージェントを起動せずにデータディレクトリのセグメントを調べるための関数群。
+// 修復以外はファイルを読み出し専用で開き、作成も切り詰めもしない。
+// Logが開いているディレクトリに対して使ってはいけない。
+
+// セグメントの概要
+type SegmentInfo struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// 次に書き込まれるレコードのオフセット。インデックスの最後のエントリから求める
+	NextOffset uint64 `json:"next_offset"`
+	StoreBytes uint64 `json:"store_bytes"`
+	IndexBytes uint64 `json:"index_bytes"`
+	// 時刻のインデックスのバイト数
+	TimeIndexBytes uint64 `json:"time_index_bytes"`
+}
+
+// 検査で見つかったセグメントの問題
+type SegmentProblem struct {
+	BaseOffset uint64 `json:"base_offset"`
+	Problem    string `json:"problem"`
+}
+
+// ディレクトリのストアとインデックスと時刻のインデックスのファイルをベースオフセットごとにまとめる
+type segmentFiles struct {
+	baseOffset uint64
+	store      bool
+	index      bool
+	timeIndex  bool
+}
+
+func listSegmentFiles(dir string) ([]*segmentFiles, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[uint64]*segmentFiles)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".store" && ext != ".index" && ext != ".timeindex") {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		f, ok := files[off]
+		if !ok {
+			f = &segmentFiles{baseOffset: off}
+			files[off] = f
+		}
+		switch ext {
+		case ".store":
+			f.store = true
+		case ".index":
+			f.index = true
+		default:
+			f.timeIndex = true
+		}
+	}
+	list := make([]*segmentFiles, 0, len(files))
+	for _, f := range files {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].baseOffset < list[j].baseOffset
+	})
+	return list, nil
+}
+
+// 検査のためにセグメントを読み出し専用で開く。newSegmentはファイルを作成し、インデックスをMaxIndexBytesまで伸ばすので使わない。
+// インデックスはmmapせずにファイルの内容を読み込み、時刻のインデックスがない場合は空として扱う。閉じる時はcloseSegmentを使う
+func openSegment(dir string, baseOffset uint64) (*segment, error) {
+	s := &segment{baseOffset: baseOffset, dir: dir}
+	f, err := os.Open(s.storeName())
+	if err != nil {
+		return nil, err
+	}
+	if s.store, err = newStore(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	b, err := os.ReadFile(s.indexName())
+	if err != nil {
+		s.store.Close()
+		return nil, err
+	}
+	s.index = &index{mmap: b, size: uint64(len(b))}
+	b, err = os.ReadFile(s.timeIndexName())
+	if err != nil && !os.IsNotExist(err) {
+		s.store.Close()
+		return nil, err
+	}
+	s.timeIndex = &timeIndex{mmap: b, size: uint64(len(b))}
+	if err := s.load(); err != nil {
+		s.store.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSegmentで開いたセグメントを閉じる。インデックスはファイルを開いていないので、ストアだけを閉じる
+func closeSegment(s *segment) error {
+	return s.store.Close()
+}
+
+// ストアとインデックスの両方が揃ったセグメントの一覧を返す。
+func ListSegments(dir string) ([]SegmentInfo, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []SegmentInfo
+	for _, f := range files {
+		if !f.store || !f.index {
+			continue
+		}
+		s, err := openSegment(dir, f.baseOffset)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, SegmentInfo{
+			BaseOffset:     s.baseOffset,
+			NextOffset:     s.nextOffset,
+			StoreBytes:     s.store.size,
+			IndexBytes:     s.index.size,
+			TimeIndexBytes: s.timeIndex.size,
+		})
+		if err := closeSegment(s); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// 指定されたオフセットのレコードを読み出す。
+func ReadRecords(dir string, offsets []uint64) ([]*api.Record, error) {
+	infos, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*api.Record, 0, len(offsets))
+	for _, off := range offsets {
+		var info *SegmentInfo
+		for i := range infos {
+			if infos[i].BaseOffset <= off && off < infos[i].NextOffset {
+				info = &infos[i]
+			}
+		}
+		if info == nil {
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		s, err := openSegment(dir, info.BaseOffset)
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.Read(off)
+		if cerr := closeSegment(s); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// 全てのセグメントについて、ストアとインデックスと時刻のインデックスが揃っているか、インデックスのエントリがストアのレコードを指しているかを調べる。
+func CheckSegments(dir string) ([]SegmentProblem, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []SegmentProblem
+	for _, f := range files {
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, SegmentProblem{
+				BaseOffset: f.baseOffset,
+				Problem:    fmt.Sprintf(format, args...),
+			})
+		}
+		if !f.store && !f.index {
+			report("time index has no store")
+			continue
+		}
+		if !f.index {
+			report("store has no index")
+			continue
+		}
+		if !f.store {
+			report("index has no store")
+			continue
+		}
+		if !f.timeIndex {
+			report("store has no time index")
+		}
+		if err := checkSegment(dir, f.baseOffset, report); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+func checkSegment(dir string, baseOffset uint64, report func(string, ...interface{})) error {
+	positions, size, valid, _, err := scanStore(
+		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+	)
+	if err != nil {
+		return err
+	}
+	if valid < size {
+		report("store has %d bytes of torn or corrupt data at position %d", size-valid, valid)
+	}
+
+	s, err := openSegment(dir, baseOffset)
+	if err != nil {
+		return err
+	}
+	defer closeSegment(s)
+	if s.index.size%entWidth != 0 {
+		report("index size %d is not a multiple of the entry width", s.index.size)
+	}
+	// 疎なインデックスでは全てのレコードがエントリを持つとは限らないが、エントリの相対オフセットは0から始まって増えていく
+	entries := s.index.size / entWidth
+	if entries == 0 && len(positions) > 0 {
+		report("%d records in the store are missing from the index", len(positions))
+	}
+	var prev uint32
+	for i := uint64(0); i < entries; i++ {
+		off, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return err
+		}
+		if (i == 0 && off != 0) || (i > 0 && off <= prev) {
+			report("index entry %d has relative offset %d", i, off)
+			continue
+		}
+		prev = off
+		abs := baseOffset + uint64(off)
+		if uint64(off) >= uint64(len(positions)) || positions[off] != pos {
+			report("index entry %d points to position %d, which is not the record at offset %d", i, pos, abs)
+			continue
+		}
+		p, err := s.store.Read(pos)
+		if err != nil {
+			report("record at offset %d: %v", abs, err)
+			continue
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			report("record at offset %d: %v", abs, err)
+			continue
+		}
+		if record.Offset != abs {
+			report("record at offset %d has offset %d", abs, record.Offset)
+		}
+	}
+	return nil
+}
+
+// ストアの途切れた末尾と壊れたレコード以降を切り捨て、インデックスをストアから作り直す。修復したセグメントの一覧を返す。
+// 壊れたレコードより後ろのレコードも失うので、切り捨てる前にcheckで確認する。
+// インデックスのないストアにはインデックスを作る。ストアのないインデックスは修復できないので何もしない。
+// インデックスはcのインデックスの密度で作るので、ログと同じ設定を渡す。
+func RepairSegments(dir string, c Config) ([]SegmentRepair, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var repairs []SegmentRepair
+	for _, f := range files {
+		if !f.store {
+			continue
+		}
+		repair, err := recoverSegment(dir, f.baseOffset, c, truncateAll)
+		if err != nil {
+			return nil, err
+		}
+		if repair != nil {
+			repairs = append(repairs, *repair)
+		}
+	}
+	return repairs, nil
+}
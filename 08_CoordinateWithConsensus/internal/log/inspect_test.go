@@ -0,0 +1,111 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	infos, err := ListSegments(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, uint64(0), infos[0].BaseOffset)
+	require.Equal(t, uint64(3), infos[0].NextOffset)
+	require.Equal(t, uint64(3*entWidth), infos[0].IndexBytes)
+	require.Equal(t, uint64(3), infos[1].BaseOffset)
+	require.Equal(t, uint64(4), infos[1].NextOffset)
+	require.NotZero(t, infos[1].StoreBytes)
+
+	records, err := ReadRecords(dir, []uint64{1, 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), records[0].Offset)
+	require.Equal(t, uint64(3), records[1].Offset)
+	_, err = ReadRecords(dir, []uint64{4})
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+
+	// 検査はファイルを書き換えない
+	before := readDir(t, dir)
+	problems, err := CheckSegments(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	again, err := ListSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, infos, again)
+	require.Equal(t, before, readDir(t, dir))
+
+	// インデックスの2番目のエントリを壊し、ストアしかないセグメントとインデックスしかないセグメントを作る
+	index := filepath.Join(dir, "0.index")
+	b, err := os.ReadFile(index)
+	require.NoError(t, err)
+	enc.PutUint64(b[entWidth+offWidth:], 1)
+	require.NoError(t, os.WriteFile(index, b, 0600))
+	require.NoError(t, os.Remove(filepath.Join(dir, "3.index")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "10.index"), nil, 0600))
+	// 時刻のインデックスがないセグメントと、時刻のインデックスしかないセグメントも作る
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.timeindex")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20.timeindex"), nil, 0600))
+
+	before = readDir(t, dir)
+	problems, err = CheckSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentProblem{
+		{BaseOffset: 0, Problem: "store has no time index"},
+		{BaseOffset: 0, Problem: "index entry 1 points to position 1, which is not the record at offset 1"},
+		{BaseOffset: 3, Problem: "store has no index"},
+		{BaseOffset: 10, Problem: "index has no store"},
+		{BaseOffset: 20, Problem: "time index has no store"},
+	}, problems)
+	_, err = ListSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, before, readDir(t, dir))
+
+	repairs, err := RepairSegments(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{
+		{BaseOffset: 0, Records: 3, IndexRebuilt: true, TimeIndexRebuilt: true},
+		{BaseOffset: 3, Records: 1, IndexRebuilt: true},
+	}, repairs)
+	require.NoError(t, os.Remove(filepath.Join(dir, "10.index")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "20.timeindex")))
+
+	problems, err = CheckSegments(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	records, err = ReadRecords(dir, []uint64{1, 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), records[0].Offset)
+	require.Equal(t, uint64(3), records[1].Offset)
+}
+
+// ディレクトリのファイルの名前と内容を返す
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	files := make(map[string]string)
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		require.NoError(t, err)
+		files[entry.Name()] = string(b)
+	}
+	return files
+}
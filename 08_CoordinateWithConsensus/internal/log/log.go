@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	api "github.com/lottotto/proglog/api/v1"
+	"go.uber.org/zap"
 )
 
 // ログはセグメントの集まりと書き込みを追加するアクティブセグメントへのポインタで構成される
@@ -19,6 +20,17 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	// 封印済みのセグメントのうち開いているものを制限する
+	cache *segmentCache
+	// 起動時のリカバリで修復したセグメント
+	repairs []SegmentRepair
+	logger  *zap.Logger
+	// SyncGroupの時のみ使う
+	syncer *groupSyncer
+	// Config.Retentionが指定されている時のみ使う
+	janitor *janitor
+	// レコードが追加されるたびに閉じて作り直す。待っている読み出し側に追加を知らせる
+	appended chan struct{}
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -28,37 +40,87 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.Sync == SyncDefault {
+		c.Segment.Sync = SyncOS
+	}
+	if c.Segment.MaxOpenSegments == 0 {
+		c.Segment.MaxOpenSegments = 64
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		logger:   zap.L().Named("log"),
+		appended: make(chan struct{}),
 	}
+	l.cache = newSegmentCache(int(c.Segment.MaxOpenSegments), l.logger)
 	return l, l.setup()
 }
 
+// Closeが正常に終わった時に置くファイル。開く時にこれがあればセグメントの修復を省く
+const cleanShutdownFile = "clean_shutdown"
+
 // ログの開始処理としてディスク上のセグメントの一覧を取得し、ファイル名からベースオフセットの値を求めてソートする。ディスク上にすでに存在するセグメントを処理して設定する。
 func (l *Log) setup() error {
+	clean, err := l.takeCleanShutdown()
+	if err != nil {
+		return err
+	}
 	files, err := os.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
+	// セグメントはストア、インデックス、時刻のインデックスの複数のファイルを持つので、ベースオフセットの重複を除く
 	var baseOffsets []uint64
+	seen := make(map[uint64]bool)
 	for _, file := range files {
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil || seen[off] {
+			continue
+		}
+		seen[off] = true
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 	for i := 0; i < len(baseOffsets); i++ {
+		// 先頭の削除でセグメントを書き直している途中に落ちた場合は、古いセグメントが残っているので書きかけのセグメントを捨てる
+		if l.activeSegment != nil && baseOffsets[i] < l.activeSegment.nextOffset {
+			if err := l.discardSegment(baseOffsets[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		// 異常終了していた場合に備えて、セグメントを開く前にストアとインデックスを修復する。
+		// 途切れた末尾を切り捨てるのは書き込み中だった最後のセグメントだけで、他のセグメントが壊れている場合はエラーにする
+		var repair *SegmentRepair
+		if !clean {
+			mode := truncateNone
+			if i == len(baseOffsets)-1 {
+				mode = truncateTorn
+			}
+			if repair, err = recoverSegment(l.Dir, baseOffsets[i], l.Config, mode); err != nil {
+				return err
+			}
+		}
+		if repair != nil {
+			l.repairs = append(l.repairs, *repair)
+			l.logger.Warn(
+				"repaired segment",
+				zap.Uint64("base_offset", repair.BaseOffset),
+				zap.Uint64("records", repair.Records),
+				zap.Uint64("truncated_bytes", repair.TruncatedBytes),
+				zap.Bool("index_rebuilt", repair.IndexRebuilt),
+				zap.Bool("time_index_rebuilt", repair.TimeIndexRebuilt),
+			)
+		}
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		// baseOffsetsはインデックスとストアの2つの重複を含んでいるので、重複するものをスキップする
-		i++
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -67,63 +129,232 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	if l.Config.Segment.Sync == SyncGroup {
+		l.syncer = newGroupSyncer(
+			l.Config.Segment.SyncInterval,
+			l.Config.Segment.SyncBytes,
+		)
+		l.syncer.run(l.groupSync)
+	}
+	if l.Config.hasRetention() {
+		l.janitor = newJanitor(l.Config.Retention.CheckInterval)
+		l.janitor.run(l.cleanRetention)
+	}
 	return nil
 }
 
 // ログにレコードを追加する。アクティブセグメントがいっぱいだったら、新しいセグメントを作成し、それをアクティブセグメントとする。
 // Appendメソッドを排他的にするため、mutexを使って排他ロックをしている。
+// Config.Segment.Syncで指定された永続化が済んでから返る。
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	// 大文字の方のHighestにするとエラーになる
-	highestOffset, err := l.highestOffset()
+	offs, err := l.AppendBatch([]*api.Record{record})
 	if err != nil {
 		return 0, err
 	}
+	return offs[0], nil
+}
+
+// 複数のレコードを1回のロックでまとめて追加し、それぞれのオフセットを返す。
+// 途中でアクティブセグメントがいっぱいになった場合は新しいセグメントに続けて書き込む。
+// 永続化もバッチの最後にまとめて行う。エラーが返った場合、それより前のレコードは追加されている可能性がある。
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	offs, wait, err := l.appendBatch(records)
+	if err != nil {
+		return nil, err
+	}
+	// グループコミットの場合はロックを離してからfsyncを待つ
+	if wait != nil {
+		if err := <-wait; err != nil {
+			return nil, err
+		}
+	}
+	return offs, nil
+}
 
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(highestOffset + 1)
+func (l *Log) appendBatch(records []*api.Record) ([]uint64, <-chan error, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offs := make([]uint64, 0, len(records))
+	var written uint64
+	for _, record := range records {
+		if l.activeSegment.IsMaxed() {
+			// 書き込んだレコードが古いセグメントに残らないように、切り替える前に永続化する
+			if err := l.persist(l.activeSegment); err != nil {
+				return nil, nil, err
+			}
+			// 大文字の方のHighestにするとエラーになる
+			highestOffset, err := l.highestOffset()
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = l.newSegment(highestOffset + 1); err != nil {
+				return nil, nil, err
+			}
+		}
+		s := l.activeSegment
+		size := s.store.size
+		off, err := s.Append(record)
 		if err != nil {
-			return 0, err
+			return nil, nil, err
 		}
+		written += s.store.size - size
+		offs = append(offs, off)
 	}
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
-		return 0, err
+	if len(offs) > 0 {
+		close(l.appended)
+		l.appended = make(chan struct{})
 	}
-	return off, nil
+	if l.Config.Segment.Sync == SyncGroup {
+		return offs, l.syncer.wait(written), nil
+	}
+	if err := l.persist(l.activeSegment); err != nil {
+		return nil, nil, err
+	}
+	return offs, nil, nil
+}
+
+// Config.Segment.Syncに従ってセグメントのストアを書き出す。
+func (l *Log) persist(s *segment) error {
+	if l.Config.Segment.Sync == SyncOS {
+		return s.store.Flush()
+	}
+	return s.store.Sync()
+}
+
+// グループコミット待ちのAppendがあればアクティブセグメントをfsyncし、待っているAppendに結果を返す。
+// Appendと排他にするため、待ちの取り出しとfsyncはロックを取った状態で行う。
+func (l *Log) groupSync() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	waiters := l.syncer.take()
+	if len(waiters) == 0 {
+		return
+	}
+	err := l.activeSegment.store.Sync()
+	for _, w := range waiters {
+		w <- err
+	}
+}
+
+// 次にレコードが追加された時に閉じられるチャネルを返す。
+// 読み出す前に取得しておけば、読み出した後に追加されたレコードを取りこぼさずに待つことができる。
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
 }
 
 // 指定されたオフセットに格納されているレコードを読み出す。
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	// まずは指定されたレコードを含むセグメントを見つける。セグメントは古い順に並んでいる
-	for _, segment := range l.segments {
-		// セグメントのベースオフセットはセグメント内の最小のオフセットであるから、ベースオフセットが探しているオフセットであり、
-		// かつnextoffsetが探しているオフセットより大きい最初のセグメントになる。
-		if segment.baseOffset <= off && off <= segment.nextOffset {
-			s = segment
-			break
-		}
-	}
-	if s == nil || s.nextOffset <= off {
+	s := l.findSegment(off)
+	if s == nil {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
-		// return nil, fmt.Errorf("offset out of range: %d", off)
 	}
+	// 封印済みのセグメントは閉じられていることがあるので、開いてから読む
+	if err := l.cache.acquire(s); err != nil {
+		return nil, err
+	}
+	defer l.cache.release(s)
 	return s.Read(off)
 }
 
+// タイムスタンプ(UnixNano)がts以上の最初のレコードのオフセットを返す。そのようなレコードがない場合は次に追加されるレコードのオフセットを返す。
+// タイムスタンプは追加した時刻なので、ログの中でほぼ昇順に並んでいると仮定している。
+func (l *Log) OffsetForTime(ts int64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// 最初のレコードがtsより古い最後のセグメントに目的のレコードがあるか、なければその次のセグメントの最初のレコードになる。
+	// 空のセグメントは最初のタイムスタンプを持たないので除く
+	segments := l.segments
+	if last := segments[len(segments)-1]; last.nextOffset == last.baseOffset {
+		segments = segments[:len(segments)-1]
+	}
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].firstTimestamp >= ts
+	})
+	if i > 0 {
+		s := segments[i-1]
+		if err := l.cache.acquire(s); err != nil {
+			return 0, err
+		}
+		off, ok, err := s.OffsetForTime(ts)
+		l.cache.release(s)
+		if err != nil || ok {
+			return off, err
+		}
+	}
+	if i < len(segments) {
+		return segments[i].baseOffset, nil
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// 指定されたオフセットを含むセグメントを二分探索で見つける。含むセグメントがなければnilを返す。
+// セグメントは古い順に並んでいてオフセットの範囲は重ならないので、nextOffsetが探しているオフセットより大きい最初のセグメントになる。
+func (l *Log) findSegment(off uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return off < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || off < l.segments[i].baseOffset {
+		return nil
+	}
+	return l.segments[i]
+}
+
+// 起動時のリカバリで修復したセグメントの一覧を返す。
+func (l *Log) Repairs() []SegmentRepair {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.repairs
+}
+
 func (l *Log) Close() error {
+	l.stop()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.close()
+}
+
+// 保持条件の掃除とグループコミットを止める。どちらもl.muを取るので、l.muを持たずに呼ぶ
+func (l *Log) stop() {
+	if l.janitor != nil {
+		l.janitor.stop()
+		l.janitor = nil
+	}
+	// グループコミットを止め、残っている待ちをfsyncしてから閉じる
+	if l.syncer != nil {
+		l.syncer.stop()
+		l.groupSync()
+		l.syncer = nil
+	}
+}
+
+// セグメントを閉じて正常に閉じたことを記録する。l.muを持って呼ぶ
+func (l *Log) close() error {
+	// 正常に閉じたことを記録する前に、書き込み中のセグメントを永続化する
+	if s := l.activeSegment; s.store != nil {
+		if err := s.store.Sync(); err != nil {
+			return err
+		}
+	}
 	for _, segment := range l.segments {
+		l.cache.remove(segment)
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return writeFile(path.Join(l.Dir, cleanShutdownFile), strings.NewReader(""), 0)
+}
+
+// 前回正常に閉じたかどうかを返し、記録を消す。開いている間に異常終了した場合は次に開く時に修復する
+func (l *Log) takeCleanShutdown() (bool, error) {
+	err := os.Remove(path.Join(l.Dir, cleanShutdownFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (l *Log) Remove() error {
@@ -134,11 +365,9 @@ func (l *Log) Remove() error {
 
 }
 
+// ログを削除し、空のログとして作り直す。
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
-		return err
-	}
-	return l.setup()
+	return l.install(nil, nil)
 }
 
 func (l *Log) LowerOffset() (uint64, error) {
@@ -154,6 +383,12 @@ func (l *Log) HighestOffset() (uint64, error) {
 
 	return l.highestOffset()
 }
+
+// レコードを1つも持たない場合にtrueを返す。ロックを取った状態で呼ぶ。
+func (l *Log) empty() bool {
+	return l.activeSegment.nextOffset == l.segments[0].baseOffset
+}
+
 func (l *Log) highestOffset() (uint64, error) {
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
@@ -162,7 +397,9 @@ func (l *Log) highestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
-// Truncate: 切り捨てる。最大オフセットがlowestよりも小さいセグメントを全て削除する
+// Truncate: 切り捨てる。オフセットがlowest以下のレコードを全て削除する。
+// lowestを含むセグメントは、残すレコードをベースオフセットがlowest+1の新しいセグメントに書き直す。
+// 全てのレコードを削除した場合は、次にlowest+1から書き込む。
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -170,7 +407,7 @@ func (l *Log) Truncate(lowest uint64) error {
 	var segments []*segment
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+			if err := l.removeSegment(s); err != nil {
 				return err
 			}
 			continue
@@ -178,28 +415,156 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	if len(segments) == 0 {
+		l.activeSegment = nil
+		return l.newSegment(lowest + 1)
+	}
+	if segments[0].baseOffset <= lowest {
+		return l.rewriteSegment(segments[0], lowest+1)
+	}
 	return nil
 }
 
+// TruncateFrom: オフセットがoff以上のレコードを全て削除し、次にoffから書き込む。
+// offを含むセグメントはストアとインデックスを巻き戻し、アクティブセグメントにする。
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if off >= l.activeSegment.nextOffset {
+		return nil
+	}
+	if off <= l.segments[0].baseOffset {
+		for _, s := range l.segments {
+			if err := l.removeSegment(s); err != nil {
+				return err
+			}
+		}
+		l.segments = nil
+		l.activeSegment = nil
+		return l.newSegment(off)
+	}
+	for {
+		s := l.segments[len(l.segments)-1]
+		if s.baseOffset < off {
+			break
+		}
+		if err := l.removeSegment(s); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	s := l.segments[len(l.segments)-1]
+	if s != l.activeSegment {
+		if err := l.cache.unseal(s); err != nil {
+			return err
+		}
+		l.activeSegment = s
+	}
+	if err := s.truncateFrom(off); err != nil {
+		return err
+	}
+	return l.persist(s)
+}
+
+// sのoff以降のレコードをベースオフセットがoffの新しいセグメントに書き直し、sと置き換える。sは先頭のセグメントでなければならない。
+func (l *Log) rewriteSegment(s *segment, off uint64) error {
+	if err := l.cache.acquire(s); err != nil {
+		return err
+	}
+	ns, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		l.cache.release(s)
+		return err
+	}
+	for o := off; o < s.nextOffset; o++ {
+		record, err := s.Read(o)
+		if err == nil {
+			_, err = ns.Append(record)
+		}
+		if err != nil {
+			l.cache.release(s)
+			_ = ns.Remove()
+			return err
+		}
+	}
+	l.cache.release(s)
+	// 古いセグメントを削除する前に新しいセグメントを永続化する
+	if err := ns.store.Sync(); err != nil {
+		return err
+	}
+	if err := l.removeSegment(s); err != nil {
+		return err
+	}
+	l.segments[0] = ns
+	if s == l.activeSegment {
+		l.activeSegment = ns
+	} else {
+		l.cache.add(ns)
+	}
+	return nil
+}
+
+// 起動時に、前のセグメントと重なっている書きかけのセグメントのファイルを削除する。
+func (l *Log) discardSegment(base uint64) error {
+	s := &segment{baseOffset: base, dir: l.Dir}
+	for _, name := range []string{s.storeName(), s.indexName(), s.timeIndexName()} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.logger.Warn(
+		"discarded overlapping segment",
+		zap.Uint64("base_offset", base),
+	)
+	return nil
+}
+
+func (l *Log) removeSegment(s *segment) error {
+	l.cache.remove(s)
+	return s.Remove()
+}
+
+// ログ全体をストアのフレーム形式のまま読み出すReaderを返す。フレームはチェックサムを検証してから返す。
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{cache: l.cache, segment: segment}
 	}
 	return io.MultiReader(readers...)
 }
 
+// *os.FileのWriteToが昇格してio.CopyがReadを経由しなくなるので、storeは埋め込まない
 type originReader struct {
-	*store
-	off int64
+	cache   *segmentCache
+	segment *segment
+	off     uint64
+	// 検証済みでまだ読み出されていないフレーム
+	frame []byte
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+	if len(o.frame) == 0 {
+		if err := o.cache.acquire(o.segment); err != nil {
+			return 0, err
+		}
+		frame, _, err := o.segment.store.readFrameAt(o.off)
+		o.cache.release(o.segment)
+		if err != nil {
+			if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+				corrupt.BaseOffset = o.segment.baseOffset
+				return 0, corrupt
+			}
+			return 0, err
+		}
+		o.frame = frame
+		o.off += uint64(len(frame))
+	}
+	n := copy(p, o.frame)
+	o.frame = o.frame[n:]
+	return n, nil
 }
 
 func (l *Log) newSegment(off uint64) error {
@@ -207,6 +572,10 @@ func (l *Log) newSegment(off uint64) error {
 	if err != nil {
 		return err
 	}
+	// それまでのアクティブセグメントは封印され、LRUで閉じられるようになる
+	if l.activeSegment != nil {
+		l.cache.add(l.activeSegment)
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/lottotto/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -14,8 +17,14 @@ func TestLog(t *testing.T) {
 	for scenario, fn := range map[string]func(
 		t *testing.T, log *Log,
 	){
-		"append and read a record succeeds": testAppendRead,
-		"offset out of range error":         testOutOfRangeErr,
+		"append and read a record succeeds":  testAppendRead,
+		"offset out of range error":          testOutOfRangeErr,
+		"read the first record of a segment": testReadSegmentBoundary,
+		"reader detects a corrupt record":    testReaderCorrupt,
+		"append batch across segments":       testAppendBatch,
+		"append notifies waiting readers":    testAppended,
+		"offset for time across segments":    testOffsetForTime,
+		"reset while reading":                testResetWhileReading,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -32,6 +41,115 @@ func TestLog(t *testing.T) {
 	}
 }
 
+func TestLogSyncPolicy(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		sync SyncPolicy
+		fn   func(t *testing.T, log *Log, syncs func() int)
+	}{
+		"os never fsyncs":              {SyncOS, testSyncOS},
+		"always fsyncs every append":   {SyncAlways, testSyncAlways},
+		"group fsyncs waiting appends": {SyncGroup, testSyncGroup},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "sync-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			var mu sync.Mutex
+			var n int
+			defer func(orig func(*os.File) error) { fsync = orig }(fsync)
+			fsync = func(f *os.File) error {
+				mu.Lock()
+				n++
+				mu.Unlock()
+				return f.Sync()
+			}
+			syncs := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return n
+			}
+
+			c := Config{}
+			c.Segment.Sync = tc.sync
+			// グループコミットはテストから同期するので、時間と量では同期しない
+			c.Segment.SyncInterval = time.Hour
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			tc.fn(t, log, syncs)
+		})
+	}
+}
+
+func syncTestRecords(n int) []*api.Record {
+	var records []*api.Record
+	for i := 0; i < n; i++ {
+		records = append(records, &api.Record{Value: []byte("hello world")})
+	}
+	return records
+}
+
+// Appendが返った時点でレコードはファイルに書き出されている
+func requireFlushed(t *testing.T, log *Log) {
+	t.Helper()
+	s := log.activeSegment
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, s.store.size, uint64(fi.Size()))
+}
+
+func testSyncOS(t *testing.T, log *Log, syncs func() int) {
+	for _, record := range syncTestRecords(5) {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+		requireFlushed(t, log)
+	}
+	_, err := log.AppendBatch(syncTestRecords(3))
+	require.NoError(t, err)
+	requireFlushed(t, log)
+	require.Equal(t, 0, syncs())
+}
+
+func testSyncAlways(t *testing.T, log *Log, syncs func() int) {
+	for i, record := range syncTestRecords(5) {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+		require.Equal(t, i+1, syncs())
+	}
+	// バッチは最後にまとめて1回fsyncする
+	_, err := log.AppendBatch(syncTestRecords(3))
+	require.NoError(t, err)
+	require.Equal(t, 6, syncs())
+}
+
+func testSyncGroup(t *testing.T, log *Log, syncs func() int) {
+	var wg sync.WaitGroup
+	for _, record := range syncTestRecords(3) {
+		wg.Add(1)
+		go func(record *api.Record) {
+			defer wg.Done()
+			_, err := log.Append(record)
+			require.NoError(t, err)
+		}(record)
+	}
+	// 3つのAppendがfsyncを待っている間は同期しない
+	require.Eventually(t, func() bool {
+		log.syncer.mu.Lock()
+		defer log.syncer.mu.Unlock()
+		return len(log.syncer.waiters) == 3
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 0, syncs())
+
+	// 1回のfsyncで待っているAppendが全て返る
+	log.groupSync()
+	wg.Wait()
+	require.Equal(t, 1, syncs())
+	log.groupSync()
+	require.Equal(t, 1, syncs())
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -46,6 +164,120 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.NoError(t, log.Close())
 }
 
+func testAppendBatch(t *testing.T, log *Log) {
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	offs, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offs)
+	// MaxStoreBytesが小さいのでバッチの途中でセグメントが切り替わる
+	require.True(t, len(log.segments) > 1)
+
+	for i, off := range offs {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, read.Value)
+	}
+	require.NoError(t, log.Close())
+}
+
+func testAppended(t *testing.T, log *Log) {
+	appended := log.Appended()
+	select {
+	case <-appended:
+		t.Fatal("notified before append")
+	default:
+	}
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case <-appended:
+	case <-time.After(time.Second):
+		t.Fatal("not notified after append")
+	}
+	// 通知の後は新しいチャネルで次の追加を待つ
+	require.NotEqual(t, appended, log.Appended())
+	require.NoError(t, log.Close())
+}
+
+func testResetWhileReading(t *testing.T, log *Log) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// 作り直している途中のログを読んでもパニックしない。レコードがない場合のエラーは無視する
+			_, _ = log.LowerOffset()
+			_, _ = log.HighestOffset()
+			_, _ = log.OffsetForTime(0)
+			_, _ = log.Read(0)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 3; j++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		require.NoError(t, log.Reset())
+	}
+	close(done)
+	wg.Wait()
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, log.Close())
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	off, err := log.OffsetForTime(100)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// 10, 20, ..., 50の時刻に追加されたことにする。MaxStoreBytesが小さいのでセグメントをまたぐ
+	for i := int64(1); i <= 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world"), Timestamp: i * 10})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+	for ts, want := range map[int64]uint64{
+		0:  0,
+		10: 0,
+		15: 1,
+		30: 2,
+		41: 4,
+		50: 4,
+		// 全てのレコードより新しい場合は次に追加されるオフセット
+		51: 5,
+	} {
+		off, err := log.OffsetForTime(ts)
+		require.NoError(t, err)
+		require.Equal(t, want, off, "timestamp %d", ts)
+	}
+
+	// タイムスタンプを持たないレコードには追加した時刻を付与する
+	before := time.Now().UnixNano()
+	off, err = log.Append(&api.Record{Value: []byte("now")})
+	require.NoError(t, err)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, read.Timestamp, before)
+	got, err := log.OffsetForTime(before)
+	require.NoError(t, err)
+	require.Equal(t, off, got)
+	require.NoError(t, log.Close())
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
@@ -53,6 +285,26 @@ func testOutOfRangeErr(t *testing.T, log *Log) {
 	require.Equal(t, uint64(1), apiErr.Offset)
 }
 
+// セグメントのnextOffsetは次のセグメントのベースオフセットと等しいので、境界のオフセットは次のセグメントから読む
+func testReadSegmentBoundary(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 1)
+	for _, s := range log.segments {
+		if s.nextOffset == s.baseOffset {
+			continue
+		}
+		read, err := log.Read(s.baseOffset)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", s.baseOffset), string(read.Value))
+	}
+	_, err := log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+	require.NoError(t, log.Close())
+}
+
 func testInitExisting(t *testing.T, o *Log) {
 	append := &api.Record{
 		Value: []byte("Hello world"),
@@ -97,12 +349,40 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[lenWidth+crcWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 	require.NoError(t, log.Close())
 }
 
+func testReaderCorrupt(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	// ストアファイル上のレコードの末尾を1ビット反転させる
+	s := log.activeSegment
+	b := make([]byte, 1)
+	_, err = s.store.ReadAt(b, int64(s.store.size-1))
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	b[0] ^= 1
+	_, err = f.WriteAt(b, int64(s.store.size-1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	want := api.ErrCorruptRecord{BaseOffset: s.baseOffset, Pos: 0}
+	_, err = log.Read(off)
+	require.Equal(t, want, err)
+
+	_, err = io.ReadAll(log.Reader())
+	require.Equal(t, want, err)
+	require.NoError(t, log.Close())
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -119,3 +399,228 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	require.NoError(t, log.Close())
 }
+
+func TestLogTruncate(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"truncate removes a prefix":                testTruncate,
+		"truncate inside a segment":                testTruncatePartialSegment,
+		"truncate from rewinds the active segment": testTruncateFrom,
+		"truncate from removes all records":        testTruncateFromAll,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "truncate-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// 1つのセグメントに3つのレコードを書き込む
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, log)
+		})
+	}
+}
+
+func appendRecords(t *testing.T, log *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+}
+
+func requireRecords(t *testing.T, log *Log, lowest, highest uint64) {
+	t.Helper()
+	off, err := log.LowerOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, off)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest, off)
+	for off := lowest; off <= highest; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+	}
+}
+
+func testTruncatePartialSegment(t *testing.T, log *Log) {
+	appendRecords(t, log, 7)
+
+	// 2番目のセグメントの途中まで削除する
+	require.NoError(t, log.Truncate(4))
+	_, err := log.Read(4)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	requireRecords(t, log, 5, 6)
+
+	// 開き直しても削除したレコードは戻らない
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	requireRecords(t, log, 5, 6)
+
+	// アクティブセグメントの途中まで削除しても続けて追加できる
+	require.NoError(t, log.Truncate(5))
+	requireRecords(t, log, 6, 6)
+	off, err := log.Append(&api.Record{Value: []byte("record 7")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	requireRecords(t, log, 6, 7)
+
+	// 全て削除した場合は続きのオフセットから追加する
+	require.NoError(t, log.Truncate(9))
+	off, err = log.Append(&api.Record{Value: []byte("record 10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	requireRecords(t, log, 10, 10)
+	require.NoError(t, log.Close())
+}
+
+func testTruncateFrom(t *testing.T, log *Log) {
+	appendRecords(t, log, 7)
+
+	// 封印済みのセグメントの途中から削除すると、そのセグメントに続けて追加する
+	require.NoError(t, log.TruncateFrom(4))
+	require.Len(t, log.segments, 2)
+	_, err := log.Read(4)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	requireRecords(t, log, 0, 3)
+
+	for i := 4; i < 7; i++ {
+		off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.Len(t, log.segments, 3)
+	requireRecords(t, log, 0, 6)
+
+	// 開き直しても巻き戻したストアとインデックスから読める
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	requireRecords(t, log, 0, 6)
+	require.Empty(t, log.Repairs())
+
+	// 削除するレコードがない場合は何もしない
+	require.NoError(t, log.TruncateFrom(7))
+	requireRecords(t, log, 0, 6)
+	require.NoError(t, log.Close())
+}
+
+func testTruncateFromAll(t *testing.T, log *Log) {
+	appendRecords(t, log, 4)
+
+	require.NoError(t, log.TruncateFrom(0))
+	require.Len(t, log.segments, 1)
+	_, err := log.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("record 0")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	requireRecords(t, log, 0, 0)
+	require.NoError(t, log.Close())
+}
+
+// 先頭の削除でセグメントを書き直している途中に落ちた場合、書きかけのセグメントを捨てて古いセグメントを使う
+func TestLogDiscardOverlappingSegment(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+	require.NoError(t, log.Close())
+
+	// ベースオフセットが2の書きかけのセグメント
+	s, err := newSegment(dir, 2, c)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 1)
+	requireRecords(t, log, 0, 2)
+	_, err = os.Stat(s.storeName())
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, log.Close())
+}
+
+// セグメントを先頭から順に調べていた以前の探し方。ベンチマークで二分探索と比べるために残す
+func linearFindSegment(segments []*segment, off uint64) *segment {
+	for _, s := range segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+func BenchmarkFindSegment(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		segments := make([]*segment, n)
+		for i := range segments {
+			segments[i] = &segment{baseOffset: uint64(i) * 10, nextOffset: uint64(i+1) * 10}
+		}
+		l := &Log{segments: segments}
+		// 最も新しいセグメントを探す場合が以前の探し方の最悪になる
+		off := uint64(n)*10 - 1
+		b.Run(fmt.Sprintf("linear/segments=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if linearFindSegment(segments, off) == nil {
+					b.Fatal("segment not found")
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("binary/segments=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if l.findSegment(off) == nil {
+					b.Fatal("segment not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		for _, open := range []uint64{16, uint64(n)} {
+			b.Run(fmt.Sprintf("segments=%d/open=%d", n, open), func(b *testing.B) {
+				dir, err := os.MkdirTemp("", "read-bench")
+				require.NoError(b, err)
+				defer os.RemoveAll(dir)
+
+				c := Config{}
+				c.Segment.MaxIndexBytes = entWidth * 10
+				c.Segment.MaxOpenSegments = open
+				l, err := NewLog(dir, c)
+				require.NoError(b, err)
+				defer l.Close()
+				records := make([]*api.Record, n*10)
+				for i := range records {
+					records[i] = &api.Record{Value: []byte("hello world")}
+				}
+				_, err = l.AppendBatch(records)
+				require.NoError(b, err)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// 消費者が先頭から順に読み進める場合
+					if _, err := l.Read(uint64(i % len(records))); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// raftがLogStoreに期待する振る舞いを確かめる
+func TestLogStore(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, store *logStore,
+	){
+		"empty store has no indexes":            testLogStoreEmpty,
+		"store and get logs across segments":    testLogStoreStoreGet,
+		"delete a prefix inside a segment":      testLogStoreDeletePrefix,
+		"delete a conflicting suffix":           testLogStoreDeleteSuffix,
+		"delete all and store after a snapshot": testLogStoreDeleteAll,
+		"delete a range in the middle fails":    testLogStoreDeleteMiddle,
+		"logs persist across restarts":          testLogStoreRestart,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "logstore-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// raftのインデックスは1から始まる。1つのセグメントに3つのエントリを書き込む
+			c := Config{}
+			c.Segment.InitialOffset = 1
+			c.Segment.MaxIndexBytes = entWidth * 3
+			store, err := newLogStore(dir, c)
+			require.NoError(t, err)
+			defer store.Close()
+
+			fn(t, store)
+		})
+	}
+}
+
+func raftLogs(first, last, term uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  term,
+			Type:  raft.LogCommand,
+			Data:  []byte(fmt.Sprintf("log %d", i)),
+		})
+	}
+	return logs
+}
+
+func requireIndexes(t *testing.T, store *logStore, first, last uint64) {
+	t.Helper()
+	idx, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, idx)
+	idx, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, idx)
+}
+
+func requireLog(t *testing.T, store *logStore, index, term uint64) {
+	t.Helper()
+	var out raft.Log
+	require.NoError(t, store.GetLog(index, &out))
+	require.Equal(t, index, out.Index)
+	require.Equal(t, term, out.Term)
+	require.Equal(t, raft.LogCommand, out.Type)
+	require.Equal(t, fmt.Sprintf("log %d", index), string(out.Data))
+}
+
+func requireNoLog(t *testing.T, store *logStore, index uint64) {
+	t.Helper()
+	var out raft.Log
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(index, &out))
+}
+
+func testLogStoreEmpty(t *testing.T, store *logStore) {
+	requireIndexes(t, store, 0, 0)
+	requireNoLog(t, store, 1)
+}
+
+func testLogStoreStoreGet(t *testing.T, store *logStore) {
+	require.NoError(t, store.StoreLogs(raftLogs(1, 5, 1)))
+	require.NoError(t, store.StoreLog(raftLogs(6, 6, 2)[0]))
+	requireIndexes(t, store, 1, 6)
+	for i := uint64(1); i <= 5; i++ {
+		requireLog(t, store, i, 1)
+	}
+	requireLog(t, store, 6, 2)
+	requireNoLog(t, store, 7)
+}
+
+func testLogStoreDeletePrefix(t *testing.T, store *logStore) {
+	require.NoError(t, store.StoreLogs(raftLogs(1, 7, 1)))
+
+	// 2番目のセグメントの途中までのエントリもすべて消える
+	require.NoError(t, store.DeleteRange(1, 5))
+	requireIndexes(t, store, 6, 7)
+	for i := uint64(1); i <= 5; i++ {
+		requireNoLog(t, store, i)
+	}
+	requireLog(t, store, 6, 1)
+	requireLog(t, store, 7, 1)
+
+	require.NoError(t, store.StoreLogs(raftLogs(8, 9, 1)))
+	requireIndexes(t, store, 6, 9)
+	requireLog(t, store, 9, 1)
+}
+
+func testLogStoreDeleteSuffix(t *testing.T, store *logStore) {
+	require.NoError(t, store.StoreLogs(raftLogs(1, 7, 1)))
+
+	// 新しいリーダーと食い違ったエントリを消し、同じインデックスに書き直す
+	require.NoError(t, store.DeleteRange(5, 7))
+	requireIndexes(t, store, 1, 4)
+	requireNoLog(t, store, 5)
+
+	require.NoError(t, store.StoreLogs(raftLogs(5, 8, 2)))
+	requireIndexes(t, store, 1, 8)
+	for i := uint64(1); i <= 4; i++ {
+		requireLog(t, store, i, 1)
+	}
+	for i := uint64(5); i <= 8; i++ {
+		requireLog(t, store, i, 2)
+	}
+}
+
+func testLogStoreDeleteAll(t *testing.T, store *logStore) {
+	require.NoError(t, store.StoreLogs(raftLogs(1, 4, 1)))
+	require.NoError(t, store.DeleteRange(1, 4))
+	requireIndexes(t, store, 0, 0)
+	requireNoLog(t, store, 4)
+
+	// スナップショットをインストールした後はその次のインデックスから書き込まれる
+	require.NoError(t, store.StoreLogs(raftLogs(10, 11, 3)))
+	requireIndexes(t, store, 10, 11)
+	requireLog(t, store, 10, 3)
+	requireLog(t, store, 11, 3)
+	requireNoLog(t, store, 9)
+}
+
+func testLogStoreDeleteMiddle(t *testing.T, store *logStore) {
+	require.NoError(t, store.StoreLogs(raftLogs(1, 7, 1)))
+	require.Error(t, store.DeleteRange(3, 5))
+	requireIndexes(t, store, 1, 7)
+}
+
+func testLogStoreRestart(t *testing.T, store *logStore) {
+	require.NoError(t, store.StoreLogs(raftLogs(1, 7, 1)))
+	require.NoError(t, store.DeleteRange(1, 2))
+	require.NoError(t, store.DeleteRange(6, 7))
+	require.NoError(t, store.StoreLogs(raftLogs(6, 6, 2)))
+	require.NoError(t, store.Close())
+
+	restarted, err := newLogStore(store.Dir, store.Config)
+	require.NoError(t, err)
+	defer restarted.Close()
+	requireIndexes(t, restarted, 3, 6)
+	for i := uint64(3); i <= 5; i++ {
+		requireLog(t, restarted, i, 1)
+	}
+	requireLog(t, restarted, 6, 2)
+	requireNoLog(t, restarted, 7)
+}
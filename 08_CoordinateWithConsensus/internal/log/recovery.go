@@ -0,0 +1,221 @@
+package log
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// 起動時のリカバリでセグメントに対して行った修復の内容
+type SegmentRepair struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// ストアに残った完全なレコードの数
+	Records uint64 `json:"records"`
+	// ストアの末尾から切り捨てたバイト数
+	TruncatedBytes uint64 `json:"truncated_bytes"`
+	// インデックスをストアから作り直したかどうか
+	IndexRebuilt bool `json:"index_rebuilt"`
+	// 時刻のインデックスをストアから作り直したかどうか
+	TimeIndexRebuilt bool `json:"time_index_rebuilt"`
+}
+
+// ストアの最後の完全なレコードより後ろのデータをどこまで切り捨てるか
+type truncateMode int
+
+const (
+	// 切り捨てずにErrCorruptRecordを返す
+	truncateNone truncateMode = iota
+	// 書き込みの途中で途切れた末尾だけを切り捨てる。異常終了で途切れるのは書き込み中のアクティブセグメントだけ
+	truncateTorn
+	// 最初の不正なフレームより後ろを全て切り捨てる。後ろの正しいレコードも失うので、運用者が明示した修復でだけ使う
+	truncateAll
+)
+
+// 異常終了したセグメントを修復する。修復が不要だった場合はnilを返す。
+// ストアを先頭から走査して最後の完全なレコードより後ろのデータをmodeに従って切り捨て、
+// インデックスがストアに残ったレコードと一致しない場合はストアから作り直す。
+// newIndexはファイルをMaxIndexBytesまで伸ばすので、Closeされなかったインデックスは末尾が0埋めのまま残っている。
+// インデックスはcのインデックスの密度で作るので、密度の設定を変えた場合も作り直す。
+func recoverSegment(dir string, baseOffset uint64, c Config, mode truncateMode) (*SegmentRepair, error) {
+	repair := &SegmentRepair{BaseOffset: baseOffset}
+
+	storePath := filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	positions, size, valid, torn, err := scanStore(storePath)
+	if err != nil {
+		return nil, err
+	}
+	repair.Records = uint64(len(positions))
+	if valid < size {
+		// 途中のレコードが壊れている場合に切り捨てると、後ろの正しいレコードを黙って失い次のセグメントとの間にオフセットの欠けができる
+		if mode == truncateNone || (mode == truncateTorn && !torn) {
+			return nil, api.ErrCorruptRecord{BaseOffset: baseOffset, Pos: valid}
+		}
+		if err := os.Truncate(storePath, int64(valid)); err != nil {
+			return nil, err
+		}
+		repair.TruncatedBytes = size - valid
+	}
+
+	indexPath := filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
+	var want, wantTime []byte
+	var lastOff, lastPos uint64
+	var lastTs int64
+	store, err := os.Open(storePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if store != nil {
+		defer store.Close()
+	}
+	for i, pos := range positions {
+		off := uint64(i)
+		if !c.shouldIndex(off, pos, lastOff, lastPos, len(want) == 0) {
+			continue
+		}
+		ent := make([]byte, entWidth)
+		enc.PutUint32(ent[:offWidth], uint32(off))
+		enc.PutUint64(ent[offWidth:entWidth], pos)
+		want = append(want, ent...)
+		lastOff, lastPos = off, pos
+
+		// 時刻のインデックスはオフセットのインデックスに記録したレコードのうち、タイムスタンプが新しくなったものを記録する
+		ts, err := readTimestamp(store, pos)
+		if err != nil {
+			return nil, err
+		}
+		if ts <= lastTs {
+			continue
+		}
+		ent = make([]byte, timeEntWidth)
+		enc.PutUint64(ent[:tsWidth], uint64(ts))
+		enc.PutUint32(ent[tsWidth:timeEntWidth], uint32(off))
+		wantTime = append(wantTime, ent...)
+		lastTs = ts
+	}
+	got, err := os.ReadFile(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if string(got) != string(want) {
+		if err := writeIndexFile(indexPath, want); err != nil {
+			return nil, err
+		}
+		repair.IndexRebuilt = true
+	}
+
+	timeIndexPath := filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex"))
+	got, err = os.ReadFile(timeIndexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if string(got) != string(wantTime) {
+		if err := writeIndexFile(timeIndexPath, wantTime); err != nil {
+			return nil, err
+		}
+		repair.TimeIndexRebuilt = true
+	}
+
+	if repair.TruncatedBytes == 0 && !repair.IndexRebuilt && !repair.TimeIndexRebuilt {
+		return nil, nil
+	}
+	return repair, nil
+}
+
+// ストアのフレームを先頭から検証し、各レコードの位置とファイルのサイズ、完全なレコードが続く末尾の位置を返す。
+// tornはその後ろのデータが書き込みの途中で途切れた末尾かどうか。ファイルの終端まで続く不完全なフレームか、
+// 書き込まれなかった0埋めの領域の場合は途切れた末尾とし、チェックサムが一致しないフレームの場合は壊れたデータとする。
+func scanStore(name string) (positions []uint64, size, valid uint64, torn bool, err error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, 0, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+	size = uint64(fi.Size())
+
+	r := bufio.NewReader(f)
+	// 旧形式のフレームは最初のチェックサム付きのフレームより前にしかない
+	legacy := true
+	for {
+		frame, _, err := readStoreFrame(r, legacy)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			torn = true
+			break
+		}
+		if err == errCorruptFrame {
+			if torn, err = zeroFilled(f, int64(valid)); err != nil {
+				return nil, 0, 0, false, err
+			}
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, false, err
+		}
+		if frameVersion(frame) != frameVersionLegacy {
+			legacy = false
+		}
+		positions = append(positions, valid)
+		valid += uint64(len(frame))
+	}
+	return positions, size, valid, torn, nil
+}
+
+// posからファイルの終端までが全て0かどうか
+func zeroFilled(f *os.File, pos int64) (bool, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, pos, 1<<62))
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if b != 0 {
+			return false, nil
+		}
+	}
+}
+
+// ストアのposにあるレコードのタイムスタンプを返す。scanStoreで検証済みの位置に対して使う
+func readTimestamp(f *os.File, pos uint64) (int64, error) {
+	_, p, err := readFrame(io.NewSectionReader(f, int64(pos), 1<<62))
+	if err != nil {
+		return 0, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return 0, err
+	}
+	return record.Timestamp, nil
+}
+
+func writeIndexFile(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,200 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverUncleanShutdown(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(append)
+		require.NoError(t, err)
+	}
+	// Closeせずに終了したことにする。ストアはバッファを書き出し、インデックスはMaxIndexBytesのまま残る
+	s := l.activeSegment
+	require.NoError(t, s.store.buf.Flush())
+
+	// 書き込み途中で途切れたレコードを末尾に追加する
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	torn := encodeFrame(frameVersionCRC, make([]byte, 100))[:lenWidth+crcWidth+2]
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{{
+		BaseOffset:     0,
+		Records:        3,
+		TruncatedBytes: uint64(len(torn)),
+		IndexRebuilt:   true,
+		// 時刻のインデックスもMaxIndexBytesまで0埋めされたまま残っている
+		TimeIndexRebuilt: true,
+	}}, n.Repairs())
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	read, err := n.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+
+	off, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, n.Close())
+
+	// 正常に閉じた後は修復しない
+	n, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, n.Repairs())
+	require.NoError(t, n.Close())
+}
+
+func TestRecoverCorruptStore(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, l *Log, c Config,
+	){
+		"corrupt record in the active segment is an error": testRecoverCorruptActive,
+		"torn tail of a sealed segment is an error":        testRecoverTornSealed,
+		"zero-filled tail of the active segment is cut":    testRecoverZeroFilledTail,
+		"clean shutdown skips recovery":                    testRecoverCleanShutdown,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "recovery-corrupt-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// 0から2と3から4の2つのセグメントに書き込み、Closeせずに終了したことにする
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 5; i++ {
+				_, err := l.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, l.activeSegment.store.buf.Flush())
+
+			fn(t, l, c)
+		})
+	}
+}
+
+// セグメントのrel番目のレコードの本体を1ビット反転させる
+func corruptRecord(t *testing.T, s *segment, rel int64) uint64 {
+	t.Helper()
+	_, pos, err := s.index.Read(rel)
+	require.NoError(t, err)
+	corruptAt(t, s.storeName(), pos)
+	return pos
+}
+
+func corruptAt(t *testing.T, name string, pos uint64) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+	b := make([]byte, 1)
+	at := int64(pos + lenWidth + crcWidth)
+	_, err = f.ReadAt(b, at)
+	require.NoError(t, err)
+	b[0] ^= 1
+	_, err = f.WriteAt(b, at)
+	require.NoError(t, err)
+}
+
+func appendToFile(t *testing.T, name string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func testRecoverCorruptActive(t *testing.T, l *Log, c Config) {
+	s := l.activeSegment
+	pos := corruptRecord(t, s, 0)
+	fi, err := os.Stat(s.storeName())
+	require.NoError(t, err)
+
+	// 後ろの正しいレコードを切り捨てずにエラーにする
+	_, err = NewLog(l.Dir, c)
+	require.Equal(t, api.ErrCorruptRecord{BaseOffset: 3, Pos: pos}, err)
+	after, err := os.Stat(s.storeName())
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), after.Size())
+
+	// 運用者が修復すると壊れたレコード以降を切り捨てる
+	repairs, err := RepairSegments(l.Dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), repairs[len(repairs)-1].Records)
+	n, err := NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testRecoverTornSealed(t *testing.T, l *Log, c Config) {
+	sealed := l.segments[0]
+	appendToFile(t, sealed.storeName(), encodeFrame(frameVersionCRC, []byte("torn"))[:lenWidth+1])
+
+	_, err := NewLog(l.Dir, c)
+	require.Equal(t, api.ErrCorruptRecord{BaseOffset: 0, Pos: sealed.store.size}, err)
+}
+
+func testRecoverZeroFilledTail(t *testing.T, l *Log, c Config) {
+	appendToFile(t, l.activeSegment.storeName(), make([]byte, 16))
+
+	n, err := NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(3), n.Repairs()[0].BaseOffset)
+	require.Equal(t, uint64(16), n.Repairs()[0].TruncatedBytes)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func testRecoverCleanShutdown(t *testing.T, l *Log, c Config) {
+	sealed := l.segments[0]
+	_, pos, err := sealed.index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	_, err = os.Stat(filepath.Join(l.Dir, cleanShutdownFile))
+	require.NoError(t, err)
+	corruptAt(t, sealed.storeName(), pos)
+
+	// 正常に閉じたログはストアを走査しないので、壊れたレコードは読み出す時に見つかる
+	n, err := NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Empty(t, n.Repairs())
+	_, err = os.Stat(filepath.Join(l.Dir, cleanShutdownFile))
+	require.True(t, os.IsNotExist(err))
+	_, err = n.Read(1)
+	require.Equal(t, api.ErrCorruptRecord{BaseOffset: 0, Pos: pos}, err)
+	got, err := n.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+}
@@ -0,0 +1,107 @@
+package log
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Config.Retentionに従って古いセグメントを定期的に削除する。
+type janitor struct {
+	interval time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newJanitor(interval time.Duration) *janitor {
+	if interval == 0 {
+		interval = time.Minute
+	}
+	return &janitor{
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+func (j *janitor) run(clean func()) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.done:
+				return
+			case <-ticker.C:
+				clean()
+			}
+		}
+	}()
+}
+
+func (j *janitor) stop() {
+	close(j.done)
+	j.wg.Wait()
+}
+
+func (c Config) hasRetention() bool {
+	r := c.Retention
+	return r.MaxBytes != 0 || r.MaxAge != 0 || r.MinOffset != 0
+}
+
+func (l *Log) cleanRetention() {
+	if err := l.enforceRetention(time.Now()); err != nil {
+		l.logger.Error("failed to enforce retention", zap.Error(err))
+	}
+}
+
+// 保持条件から外れた封印済みのセグメントを古い順に削除する。
+// ログの先頭から連続して削除し、条件を満たすセグメントが見つかった時点で止める。
+func (l *Log) enforceRetention(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.Config.Retention
+
+	var total uint64
+	for _, s := range l.segments {
+		total += s.size()
+	}
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		reason := ""
+		switch {
+		case r.MinOffset != 0 && s.nextOffset <= r.MinOffset:
+			reason = "min_offset"
+		case r.MaxBytes != 0 && total > r.MaxBytes:
+			reason = "max_bytes"
+		case r.MaxAge != 0:
+			fi, err := os.Stat(s.storeName())
+			if err != nil {
+				return err
+			}
+			if now.Sub(fi.ModTime()) > r.MaxAge {
+				reason = "max_age"
+			}
+		}
+		if reason == "" {
+			return nil
+		}
+		size := s.size()
+		if err := l.removeSegment(s); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+		total -= size
+		l.logger.Info(
+			"removed segment",
+			zap.String("reason", reason),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("next_offset", s.nextOffset),
+			zap.Uint64("bytes", size),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/lottotto/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, c *Config) func(*Log){
+		"max bytes": func(t *testing.T, c *Config) func(*Log) {
+			c.Retention.MaxBytes = 250
+			return nil
+		},
+		"min offset": func(t *testing.T, c *Config) func(*Log) {
+			c.Retention.MinOffset = 6
+			return nil
+		},
+		"max age": func(t *testing.T, c *Config) func(*Log) {
+			c.Retention.MaxAge = time.Hour
+			// 最後の封印済みセグメント以外を古くする
+			return func(l *Log) {
+				old := time.Now().Add(-2 * time.Hour)
+				for _, s := range l.segments[:len(l.segments)-2] {
+					require.NoError(t, os.Chtimes(s.store.Name(), old, old))
+				}
+			}
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			// 1セグメントに2レコード
+			c.Segment.MaxIndexBytes = entWidth * 2
+			prepare := fn(t, &c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			append := &api.Record{Value: []byte("hello world")}
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(append)
+				require.NoError(t, err)
+			}
+			require.Len(t, log.segments, 5)
+			if prepare != nil {
+				prepare(log)
+			}
+
+			require.NoError(t, log.enforceRetention(time.Now()))
+
+			// アクティブセグメントは残り、先頭のセグメントから削除される
+			require.Equal(t, log.activeSegment, log.segments[len(log.segments)-1])
+			require.Len(t, log.segments, 2)
+			off, err := log.LowerOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(6), off)
+			_, err = log.Read(5)
+			require.Error(t, err)
+			_, err = log.Read(6)
+			require.NoError(t, err)
+			require.NoError(t, log.Close())
+		})
+	}
+}
+
+func TestRetentionJanitor(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-janitor-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Retention.MinOffset = 2
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		off, err := log.LowerOffset()
+		require.NoError(t, err)
+		return off == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, log.Close())
+}
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"container/list"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	api "github.com/lottotto/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -11,11 +14,22 @@ import (
 
 // セグメントとはストアとインデックスを呼び出す必要があるため、最初の2つのフィールドにそれらのポインタを保持する。
 // TODO: nextOffsetとは何かを考える
+// 封印されたセグメントはsegmentCacheによって閉じられることがあり、その間storeとindexはnilになる。
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	dir                    string
+	// 閉じている間もsize()を返せるように、閉じた時の大きさを保持する
+	storeSize, indexSize, timeIndexSize uint64
+	// 最初のレコードのタイムスタンプ。閉じている間もOffsetForTimeでセグメントを選べるように保持する
+	firstTimestamp int64
+	// segmentCacheが排他制御する
+	elem    *list.Element
+	refs    int
+	removed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -23,47 +37,99 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		dir:        dir,
 	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+
+}
+
+// 開いたストアとインデックスから次に書き込むオフセットと最初のレコードのタイムスタンプを求める。
+func (s *segment) load() error {
+	if off, pos, err := s.index.Read(-1); err != nil {
+		// おそらくEOFの時
+		s.nextOffset = s.baseOffset
+	} else {
+		// indexがある場合、次に書き込まれるレコードのオフセットはセグメントの最後のオフセットを使う必要があり、ベースオフセットと相対オフセットの和に位置を加える
+		// 疎なインデックスでは最後のエントリより後ろにもレコードがあるので、ストアを辿って数える
+		n, err := s.countFrames(pos)
+		if err != nil {
+			return err
+		}
+		s.nextOffset = s.baseOffset + uint64(off) + n
+	}
+	if ts, off, err := s.timeIndex.Read(0); err == nil && off == 0 {
+		s.firstTimestamp = ts
+	}
+	return nil
+}
+
+// ストアとインデックスのファイルを開く。
+func (s *segment) open() error {
 	storeFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		s.storeName(),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0600,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+		return err
 	}
 
 	indexFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		s.indexName(),
 		os.O_RDWR|os.O_CREATE,
 		0600,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err
+	if s.index, err = newIndex(indexFile, s.config); err != nil {
+		return err
 	}
 
-	if off, _, err := s.index.Read(-1); err != nil {
-		// おそらくEOFの時
-		s.nextOffset = baseOffset
-	} else {
-		// indexがある場合、次に書き込まれるレコードのオフセットはセグメントの最後のオフセットを使う必要があり、ベースオフセットと相対オフセットの和に位置を加える
-		s.nextOffset = baseOffset + uint64(off) + 1
+	timeIndexFile, err := os.OpenFile(
+		s.timeIndexName(),
+		os.O_RDWR|os.O_CREATE,
+		0600,
+	)
+	if err != nil {
+		return err
 	}
-	return s, nil
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, s.config); err != nil {
+		return err
+	}
+	return nil
+}
 
+func (s *segment) storeName() string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".store"))
+}
+
+func (s *segment) indexName() string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".index"))
+}
+
+func (s *segment) timeIndexName() string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".timeindex"))
 }
 
 // セグメントにレコードを書き込み、新たに追加されたレコードのオフセットを返す。
+// タイムスタンプを持たないレコードには現在時刻を付与する。
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 
 	p, err := proto.Marshal(record)
 	if err != nil {
@@ -74,25 +140,38 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 
-	if err = s.index.Write(
-		// インデックスのオフセットはベースオフセットからの相対
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+	// インデックスのオフセットはベースオフセットからの相対
+	off := s.nextOffset - s.baseOffset
+	lastOff, lastPos, err := s.index.Read(-1)
+	if s.config.shouldIndex(off, pos, uint64(lastOff), lastPos, err == io.EOF) {
+		if err = s.index.Write(uint32(off), pos); err != nil {
+			return 0, err
+		}
+		// 時刻のインデックスはオフセットのインデックスと同じ密度で記録する
+		if err = s.timeIndex.Write(record.Timestamp, uint32(off)); err != nil {
+			return 0, err
+		}
+	}
+	if off == 0 {
+		s.firstTimestamp = record.Timestamp
 	}
 	s.nextOffset++
 	return cur, nil
 }
 
 // 指定されたオフセットのレコードを返す
+// 疎なインデックスの場合は手前のエントリからストアのフレームを辿る。
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
-	if err != nil {
-		return nil, err
+	pos, err := s.position(uint32(off - s.baseOffset))
+	var p []byte
+	if err == nil {
+		p, err = s.store.Read(pos)
 	}
-	p, err := s.store.Read(pos)
 	if err != nil {
+		if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+			corrupt.BaseOffset = s.baseOffset
+			return nil, corrupt
+		}
 		return nil, err
 	}
 	record := &api.Record{}
@@ -103,6 +182,96 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, nil
 }
 
+// 相対オフセットがrelのレコードのストア内の位置を返す。
+func (s *segment) position(rel uint32) (uint64, error) {
+	cur, pos, err := s.index.Search(rel)
+	if err != nil {
+		return 0, err
+	}
+	// エントリのレコードから目的のレコードまでフレームを読み飛ばす
+	for ; cur < rel; cur++ {
+		frame, _, err := s.store.readFrameAt(pos)
+		if err != nil {
+			return 0, err
+		}
+		pos += uint64(len(frame))
+	}
+	return pos, nil
+}
+
+// オフセットがoff以降のレコードを捨て、次にoffから書き込むようにする。
+func (s *segment) truncateFrom(off uint64) error {
+	rel := uint32(off - s.baseOffset)
+	pos, err := s.position(rel)
+	if err != nil {
+		return err
+	}
+	if err := s.store.truncate(pos); err != nil {
+		return err
+	}
+	s.index.truncate(rel)
+	s.timeIndex.truncate(rel)
+	s.nextOffset = off
+	if rel == 0 {
+		s.firstTimestamp = 0
+	}
+	return nil
+}
+
+// タイムスタンプがts以上の最初のレコードのオフセットを返す。そのようなレコードがない場合はfalseを返す。
+// 時刻のインデックスでtsより古い最後のエントリを見つけ、そこからストアのレコードを順に調べる。
+func (s *segment) OffsetForTime(ts int64) (uint64, bool, error) {
+	var off uint32
+	if i := s.timeIndex.Search(ts); i > 0 {
+		_, entOff, err := s.timeIndex.Read(i - 1)
+		if err != nil {
+			return 0, false, err
+		}
+		off = entOff
+	}
+	_, pos, err := s.index.Search(off)
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	for ; s.baseOffset+uint64(off) < s.nextOffset; off++ {
+		frame, p, err := s.store.readFrameAt(pos)
+		if err != nil {
+			return 0, false, err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return s.baseOffset + uint64(off), true, nil
+		}
+		pos += uint64(len(frame))
+	}
+	return 0, false, nil
+}
+
+// posから末尾までのストアのフレームの数を返す。途切れたフレーム以降は数えない
+func (s *segment) countFrames(pos uint64) (uint64, error) {
+	var n uint64
+	for {
+		frame, _, err := s.store.readFrameAt(pos)
+		if err == io.EOF {
+			return n, nil
+		}
+		if _, ok := err.(api.ErrCorruptRecord); ok {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		pos += uint64(len(frame))
+		n++
+	}
+}
+
 // ストア、インデックスの書き込みがいっぱいになったかどうかで判断する。
 func (s *segment) IsMaxed() bool {
 
@@ -120,25 +289,45 @@ func (s *segment) IsMaxed() bool {
 	return false
 }
 
+// ストアとインデックスを合わせたバイト数
+func (s *segment) size() uint64 {
+	if s.store == nil {
+		return s.storeSize + s.indexSize + s.timeIndexSize
+	}
+	return s.store.size + s.index.size + s.timeIndex.size
+}
+
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := os.Remove(s.indexName()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := os.Remove(s.storeName()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.timeIndexName()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// ストアとインデックスを閉じる。閉じた後も開き直すことができる。
 func (s *segment) Close() error {
+	if s.store == nil {
+		return nil
+	}
+	s.storeSize, s.indexSize, s.timeIndexSize = s.store.size, s.index.size, s.timeIndex.size
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	s.store, s.index, s.timeIndex = nil, nil, nil
 	return nil
 }
@@ -4,9 +4,11 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	api "github.com/lottotto/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -63,3 +65,164 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, s.Close())
 
 }
+
+func TestSparseSegment(t *testing.T) {
+	for scenario, configure := range map[string]func(c *Config, frame uint64){
+		"every n records": func(c *Config, frame uint64) {
+			c.Segment.IndexIntervalRecords = 4
+		},
+		"every n bytes": func(c *Config, frame uint64) {
+			c.Segment.IndexIntervalBytes = frame * 4
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "sparse-segment-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// 全てのレコードが同じ大きさになるように、オフセットとタイムスタンプを固定長にする
+			want := &api.Record{Value: []byte("hello world"), Timestamp: time.Now().UnixNano()}
+			p, err := proto.Marshal(&api.Record{Value: want.Value, Offset: 16, Timestamp: want.Timestamp})
+			require.NoError(t, err)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			configure(&c, uint64(len(p))+lenWidth+crcWidth)
+
+			s, err := newSegment(dir, 16, c)
+			require.NoError(t, err)
+			for i := uint64(0); i < 10; i++ {
+				off, err := s.Append(want)
+				require.NoError(t, err)
+				require.Equal(t, 16+i, off)
+			}
+			// 0, 4, 8番目のレコードだけがエントリを持つ
+			require.Equal(t, 3*entWidth, s.index.size)
+			for i := uint64(0); i < 10; i++ {
+				got, err := s.Read(16 + i)
+				require.NoError(t, err)
+				require.Equal(t, 16+i, got.Offset)
+			}
+			_, err = s.Read(26)
+			require.Equal(t, io.EOF, err)
+			require.NoError(t, s.Close())
+
+			// 最後のエントリより後ろのレコードも数えて次のオフセットを求める
+			s, err = newSegment(dir, 16, c)
+			require.NoError(t, err)
+			require.Equal(t, uint64(26), s.nextOffset)
+			off, err := s.Append(want)
+			require.NoError(t, err)
+			require.Equal(t, uint64(26), off)
+			got, err := s.Read(26)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, got.Value)
+			require.NoError(t, s.Close())
+
+			// 正常に閉じた疎なインデックスは起動時に作り直さない
+			repair, err := recoverSegment(dir, 16, c, truncateTorn)
+			require.NoError(t, err)
+			require.Nil(t, repair)
+		})
+	}
+}
+
+func TestSegmentOffsetForTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalRecords = 3
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, ok, err := s.OffsetForTime(0)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// 16から順に10, 20, ..., 100の時刻に追加されたことにする
+	for i := int64(1); i <= 10; i++ {
+		_, err := s.Append(&api.Record{Value: []byte("hello world"), Timestamp: i * 10})
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(10), s.firstTimestamp)
+	// 時刻のインデックスは疎なオフセットのインデックスと同じく0, 3, 6, 9番目のレコードだけを記録する
+	require.Equal(t, 4*timeEntWidth, s.timeIndex.size)
+
+	for ts, want := range map[int64]uint64{
+		0:   16,
+		10:  16,
+		11:  17,
+		45:  20,
+		70:  22,
+		100: 25,
+	} {
+		off, ok, err := s.OffsetForTime(ts)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, off, "timestamp %d", ts)
+	}
+	_, ok, err = s.OffsetForTime(101)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), s.firstTimestamp)
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentRecordKeyAndHeaders(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-headers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	// キーとヘッダーを追加する前の形式のレコード(value, offset, term, typeのみ)を書き込んでおく
+	var legacy []byte
+	legacy = protowire.AppendTag(legacy, 1, protowire.BytesType)
+	legacy = protowire.AppendBytes(legacy, []byte("legacy"))
+	legacy = protowire.AppendTag(legacy, 3, protowire.VarintType)
+	legacy = protowire.AppendVarint(legacy, 2)
+	_, pos, err := s.store.Append(legacy)
+	require.NoError(t, err)
+	require.NoError(t, s.index.Write(0, pos))
+	s.nextOffset++
+
+	want := &api.Record{
+		Value: []byte("hello world"),
+		Key:   []byte("user-1"),
+		Headers: map[string][]byte{
+			"trace-id":     []byte("abc"),
+			"content-type": []byte("text/plain"),
+		},
+	}
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	got, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy"), got.Value)
+	require.Equal(t, uint64(2), got.Term)
+	require.Nil(t, got.Key)
+	require.Nil(t, got.Headers)
+
+	got, err = s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Key, got.Key)
+	require.Equal(t, want.Headers, got.Headers)
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,151 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// スナップショットに含めるセグメントのファイル。スナップショットを取った時点の大きさだけを送る
+type snapshotFile struct {
+	path string
+	size uint64
+}
+
+// ログのセグメントのファイルをdirに置き、セグメントの一覧と送るファイルを返す。
+// 封印済みのセグメントは書き換えられないのでハードリンクし、アクティブセグメントだけをコピーする。
+// ファイルはログから切り離されているので、保持条件や削除でセグメントが消えてもスナップショットは壊れない。
+func (l *Log) snapshot(dir string) ([]SegmentInfo, []snapshotFile, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	var infos []SegmentInfo
+	var files []snapshotFile
+	for _, s := range l.segments {
+		info := SegmentInfo{BaseOffset: s.baseOffset, NextOffset: s.nextOffset}
+		dst := &segment{baseOffset: s.baseOffset, dir: dir}
+		var err error
+		if s == l.activeSegment {
+			err = s.store.Flush()
+			if err == nil {
+				info.StoreBytes, info.IndexBytes, info.TimeIndexBytes = s.store.size, s.index.size, s.timeIndex.size
+				err = copySegmentFiles(dst, s, info)
+			}
+		} else {
+			info.StoreBytes, info.IndexBytes, info.TimeIndexBytes = l.cache.sizes(s)
+			err = linkSegmentFiles(dst, s)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		infos = append(infos, info)
+		files = append(files,
+			snapshotFile{path: dst.storeName(), size: info.StoreBytes},
+			snapshotFile{path: dst.indexName(), size: info.IndexBytes},
+			snapshotFile{path: dst.timeIndexName(), size: info.TimeIndexBytes},
+		)
+	}
+	return infos, files, nil
+}
+
+func linkSegmentFiles(dst, src *segment) error {
+	if err := os.Link(src.storeName(), dst.storeName()); err != nil {
+		return err
+	}
+	if err := os.Link(src.indexName(), dst.indexName()); err != nil {
+		return err
+	}
+	return os.Link(src.timeIndexName(), dst.timeIndexName())
+}
+
+func copySegmentFiles(dst, src *segment, info SegmentInfo) error {
+	if err := copyFile(dst.storeName(), src.storeName(), info.StoreBytes); err != nil {
+		return err
+	}
+	if err := copyFile(dst.indexName(), src.indexName(), info.IndexBytes); err != nil {
+		return err
+	}
+	return copyFile(dst.timeIndexName(), src.timeIndexName(), info.TimeIndexBytes)
+}
+
+// srcの先頭nバイトをdstにコピーする。インデックスはmmapへの書き込みもファイルから読める
+func copyFile(dst, src string, n uint64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFile(dst, in, n)
+}
+
+// rからnバイトを読み出してnameのファイルに書き込む。
+func writeFile(name string, r io.Reader, n uint64) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, int64(n)); err != nil {
+		f.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// スナップショットのファイルを順にwへ書き出す。
+func writeSnapshotFiles(w io.Writer, files []snapshotFile) error {
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, f, int64(file.size))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot file %s: %w", filepath.Base(file.path), err)
+		}
+	}
+	return nil
+}
+
+// ログを削除し、スナップショットのセグメントのファイルをrから読み出して置いてから開き直す。
+// セグメントがない場合は空のログとして作り直す。
+// 読み出し側が閉じたセグメントや空のセグメントの一覧を見ないように、開き直すまでl.muを持つ
+func (l *Log) install(segments []SegmentInfo, r io.Reader) error {
+	l.stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	for _, info := range segments {
+		s := &segment{baseOffset: info.BaseOffset, dir: l.Dir}
+		if err := writeFile(s.storeName(), r, info.StoreBytes); err != nil {
+			return err
+		}
+		if err := writeFile(s.indexName(), r, info.IndexBytes); err != nil {
+			return err
+		}
+		if err := writeFile(s.timeIndexName(), r, info.TimeIndexBytes); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	return l.setup()
+}
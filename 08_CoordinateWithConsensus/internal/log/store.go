@@ -2,18 +2,41 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+
+	api "github.com/lottotto/proglog/api/v1"
 )
 
 var (
 	enc = binary.BigEndian
+	// CRC32C(Castagnoli)のテーブル
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// フレームが壊れていることを示す。呼び出し元で位置を付与してErrCorruptRecordにする
+	errCorruptFrame = errors.New("corrupt frame")
+	// ストアのファイルをfsyncする。テストでは呼び出された回数を数えるために差し替える
+	fsync = (*os.File).Sync
 )
 
 const (
 	// レコードの長さを格納するためのバイト数
 	lenWidth = 8
+	// レコードのチェックサムを格納するためのバイト数
+	crcWidth = 4
+
+	// 長さの上位8ビットにフレームのバージョンを格納する。
+	// バージョン0はチェックサムを持たない旧形式で、既存のストアファイルを読めるように残している。
+	frameVersionShift  = 56
+	frameLenMask       = 1<<frameVersionShift - 1
+	frameVersionLegacy = 0
+	frameVersionCRC    = 1
+	// レコード以外のデータを運ぶフレーム。形式はframeVersionCRCと同じで、スナップショットでのみ使う
+	frameVersionMeta = 2
 )
 
 type store struct {
@@ -21,6 +44,9 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// 旧形式のフレームが続く末尾の位置。旧形式のフレームは最初のチェックサム付きのフレームより前にしか存在しないので、
+	// これより後ろでバージョン0と読めるヘッダーは壊れている
+	legacyEnd uint64
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -30,51 +56,85 @@ func newStore(f *os.File) (*store, error) {
 	}
 
 	size := uint64(fi.Size())
+	legacyEnd, err := legacyFrameEnd(f, size)
+	if err != nil {
+		return nil, err
+	}
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:      f,
+		size:      size,
+		buf:       bufio.NewWriter(f),
+		legacyEnd: legacyEnd,
 	}, nil
 }
 
-// 与えられたレコードの長さを保存し、その後レコード自体を保存する。レコードの長さはBigEndianでエンコードされたBytesが格納され、その後にレコードを保存する。
+// 先頭から旧形式のフレームのヘッダーをたどり、最初のチェックサム付きのフレームの位置を返す。
+// 旧形式のフレームがない場合は0、全て旧形式の場合はファイルの末尾になる
+func legacyFrameEnd(f *os.File, size uint64) (uint64, error) {
+	var pos uint64
+	header := make([]byte, lenWidth)
+	for pos+lenWidth <= size {
+		if _, err := f.ReadAt(header, int64(pos)); err != nil {
+			return 0, err
+		}
+		h := enc.Uint64(header)
+		if h>>frameVersionShift != frameVersionLegacy {
+			return pos, nil
+		}
+		next := pos + lenWidth + h&frameLenMask
+		if next > size {
+			break
+		}
+		pos = next
+	}
+	return pos, nil
+}
+
+// 与えられたレコードの長さとチェックサムを保存し、その後レコード自体を保存する。
+// レコードの長さ(上位8ビットはフレームのバージョン)とチェックサムはBigEndianでエンコードされたBytesが格納され、その後にレコードを保存する。
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	if err := binary.Write(s.buf, enc, frameHeader(frameVersionCRC, uint64(len(p)))); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Write(s.buf, enc, crc32.Checksum(p, crcTable)); err != nil {
 		return 0, 0, err
 	}
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += lenWidth + crcWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
-//指定された位置に格納されているレコードを戻す。
+// 指定された位置に格納されているレコードを戻す。チェックサムが一致しない場合はErrCorruptRecordを返す。
 func (s *store) Read(pos uint64) ([]byte, error) {
+	_, p, err := s.readFrameAt(pos)
+	return p, err
+}
+
+// 指定された位置のフレームを読み出して検証し、フレーム全体とレコードを返す。
+func (s *store) readFrameAt(pos uint64) (frame, p []byte, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	// レコード全体を読み込むためになんバイト必要なのかを調べる。
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	if pos >= s.size {
+		return nil, nil, io.EOF
 	}
-	// 上記のサイズ分を持つbyteのスライスを作成
-	b := make([]byte, enc.Uint64(size))
-	// 指定位置からlenWidth先のバイトから後ろを読み取る。
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	frame, p, err = readStoreFrame(
+		io.NewSectionReader(s.File, int64(pos), int64(s.size-pos)),
+		pos < s.legacyEnd,
+	)
+	if err == errCorruptFrame || err == io.ErrUnexpectedEOF {
+		return nil, nil, api.ErrCorruptRecord{Pos: pos}
 	}
-
-	return b, nil
-
+	return frame, p, err
 }
 
 // ストアファイルのoffオフセットからlen(p)バイトをpへ読み込む. なんバイト読み込んだか、を返す
@@ -87,6 +147,40 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// バッファされたデータをファイルへ書き出す。
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// バッファされたデータをファイルへ書き出し、ファイルの内容を安定したストレージへ同期する。
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return fsync(s.File)
+}
+
+// posより後ろのフレームを捨てる。posはフレームの境界でなければならない。
+func (s *store) truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	if pos < s.legacyEnd {
+		s.legacyEnd = pos
+	}
+	return nil
+}
+
 // ファイルをクローズする前にバッファされたデータを永続化する。
 func (s *store) Close() error {
 	s.mu.Lock()
@@ -97,3 +191,60 @@ func (s *store) Close() error {
 	}
 	return s.File.Close()
 }
+
+func frameHeader(version uint8, n uint64) uint64 {
+	return uint64(version)<<frameVersionShift | n&frameLenMask
+}
+
+func frameVersion(frame []byte) uint8 {
+	return uint8(enc.Uint64(frame) >> frameVersionShift)
+}
+
+// チェックサム付きのフレームを作る。
+func encodeFrame(version uint8, p []byte) []byte {
+	frame := make([]byte, lenWidth+crcWidth, lenWidth+crcWidth+len(p))
+	enc.PutUint64(frame, frameHeader(version, uint64(len(p))))
+	enc.PutUint32(frame[lenWidth:], crc32.Checksum(p, crcTable))
+	return append(frame, p...)
+}
+
+// rからフレームを1つ読み出し、フレーム全体のバイト列とレコードを返す。
+// フレームの境界で終端に達した場合はio.EOF、途中で途切れている場合はio.ErrUnexpectedEOFを返す。
+func readFrame(r io.Reader) (frame, p []byte, err error) {
+	return readStoreFrame(r, true)
+}
+
+// readFrameと同じだが、legacyがfalseの場合は旧形式のヘッダーを壊れたフレームとして扱う。
+func readStoreFrame(r io.Reader, legacy bool) (frame, p []byte, err error) {
+	header := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	h := enc.Uint64(header)
+	size := h & frameLenMask
+	var width uint64
+	switch h >> frameVersionShift {
+	case frameVersionLegacy:
+		if !legacy {
+			return nil, nil, errCorruptFrame
+		}
+	case frameVersionCRC, frameVersionMeta:
+		width = crcWidth
+	default:
+		return nil, nil, errCorruptFrame
+	}
+	// 長さが壊れていても巨大なバッファを確保しないように、読めた分だけ伸ばす
+	buf := bytes.NewBuffer(header)
+	if _, err := io.CopyN(buf, r, int64(width+size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	frame = buf.Bytes()
+	p = frame[lenWidth+width:]
+	if width == crcWidth && crc32.Checksum(p, crcTable) != enc.Uint32(frame[lenWidth:]) {
+		return nil, nil, errCorruptFrame
+	}
+	return frame, p, nil
+}
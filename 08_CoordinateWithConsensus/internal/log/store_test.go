@@ -4,12 +4,13 @@ import (
 	"os"
 	"testing"
 
+	api "github.com/lottotto/proglog/api/v1"
 	"github.com/stretchr/testify/require"
 )
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write) + lenWidth)
+	width = uint64(len(write) + lenWidth + crcWidth)
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -69,7 +70,11 @@ func testReadAt(t *testing.T, s *store) {
 		require.Equal(t, lenWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b) & frameLenMask
+		require.Equal(t, uint64(frameVersionCRC), enc.Uint64(b)>>frameVersionShift)
+
+		// チェックサムを読み飛ばす
+		off += crcWidth
 		b = make([]byte, size)
 
 		n, err = s.ReadAt(b, off)
@@ -83,6 +88,98 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreCorruptRecord(t *testing.T) {
+	f, err := os.CreateTemp("", "store_corrupt_record_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// 2つ目のレコードの本体を1ビット反転させる
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	at := int64(pos + lenWidth + crcWidth)
+	_, err = f.ReadAt(b, at)
+	require.NoError(t, err)
+	b[0] ^= 1
+	_, err = f.WriteAt(b, at)
+	require.NoError(t, err)
+
+	s, err = newStore(f)
+	require.NoError(t, err)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	_, err = s.Read(pos)
+	require.Equal(t, api.ErrCorruptRecord{Pos: pos}, err)
+	require.NoError(t, s.Close())
+}
+
+func TestStoreReadLegacyFrame(t *testing.T) {
+	f, err := os.CreateTemp("", "store_legacy_frame_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// チェックサムを持たない旧形式のフレームも読み出せる
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(write)))
+	_, err = f.Write(append(b, write...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NoError(t, s.Close())
+}
+
+func TestStoreCorruptLegacyHeader(t *testing.T) {
+	f, err := os.CreateTemp("", "store_corrupt_legacy_header_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// 旧形式のフレームの後にチェックサム付きのフレームを2つ書き込む
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(write)))
+	_, err = f.Write(append(b, write...))
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, crcPos, err := s.Append(write)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// 2つ目のチェックサム付きのフレームのバージョンを0に壊す
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{frameVersionLegacy}, int64(pos))
+	require.NoError(t, err)
+
+	s, err = newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, crcPos, s.legacyEnd)
+	for _, p := range []uint64{0, crcPos} {
+		read, err := s.Read(p)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	// 最初のチェックサム付きのフレームより後ろの旧形式のヘッダーはチェックサムを確かめずに読まない
+	_, err = s.Read(pos)
+	require.Equal(t, api.ErrCorruptRecord{Pos: pos}, err)
+	require.NoError(t, s.Close())
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncGroupの時に複数のAppendをまとめてfsyncする。
+// Appendは書き込んだ後にwaitで待ち、バックグラウンドのgoroutineがfsyncしてから結果を返す。
+type groupSyncer struct {
+	mu      sync.Mutex
+	pending uint64
+	waiters []chan error
+
+	interval time.Duration
+	bytes    uint64
+	kick     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newGroupSyncer(interval time.Duration, bytes uint64) *groupSyncer {
+	if interval == 0 {
+		interval = 10 * time.Millisecond
+	}
+	return &groupSyncer{
+		interval: interval,
+		bytes:    bytes,
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// nバイト書き込んだAppendを登録し、fsyncの結果を受け取るチャネルを返す。
+func (g *groupSyncer) wait(n uint64) <-chan error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ch := make(chan error, 1)
+	g.waiters = append(g.waiters, ch)
+	g.pending += n
+	if g.bytes != 0 && g.pending >= g.bytes {
+		select {
+		case g.kick <- struct{}{}:
+		default:
+		}
+	}
+	return ch
+}
+
+func (g *groupSyncer) take() []chan error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	waiters := g.waiters
+	g.waiters = nil
+	g.pending = 0
+	return waiters
+}
+
+// interval毎、もしくは書き込んだバイト数がbytesに達する毎にsyncを呼ぶ。
+func (g *groupSyncer) run(sync func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+			case <-g.kick:
+			}
+			sync()
+		}
+	}()
+}
+
+func (g *groupSyncer) stop() {
+	close(g.done)
+	g.wg.Wait()
+}
@@ -0,0 +1,116 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tysonmote/gommap"
+)
+
+const (
+	tsWidth      uint64 = 8
+	timeEntWidth        = tsWidth + offWidth
+)
+
+// タイムスタンプからセグメント内の相対オフセットを引くための二次インデックス。
+// エントリはオフセットのインデックスにエントリを書き込んだレコードのうち、それまでより新しいタイムスタンプを持つものだけを記録するので、
+// タイムスタンプの昇順に並び、エントリの数はオフセットのインデックスを超えない。
+type timeIndex struct {
+	file *os.File
+	mmap gommap.MMap
+	size uint64
+}
+
+// オフセットのインデックスと同じくファイルをMaxIndexBytesまで伸ばしてmmapする。
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	idx := &timeIndex{
+		file: f,
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	idx.size = uint64(fi.Size())
+	if err = os.Truncate(
+		f.Name(), int64(c.Segment.MaxIndexBytes),
+	); err != nil {
+		return nil, err
+	}
+	if idx.mmap, err = gommap.Map(
+		idx.file.Fd(),
+		gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED,
+	); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// mmapをファイルへ同期し、ファイルを実際のデータ量まで切り詰めて閉じる。
+func (t *timeIndex) Close() error {
+	if err := t.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	if err := t.file.Truncate(int64(t.size)); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+// in番目のエントリのタイムスタンプと相対オフセットを返す。-1の場合は最後のエントリを返す。
+func (t *timeIndex) Read(in int64) (ts int64, off uint32, err error) {
+	n := int64(t.size / timeEntWidth)
+	if in == -1 {
+		in = n - 1
+	}
+	if in < 0 || in >= n {
+		return 0, 0, io.EOF
+	}
+	pos := uint64(in) * timeEntWidth
+	ts = int64(enc.Uint64(t.mmap[pos : pos+tsWidth]))
+	off = enc.Uint32(t.mmap[pos+tsWidth : pos+timeEntWidth])
+	return ts, off, nil
+}
+
+// タイムスタンプがts以上の最初のエントリの番号を返す。全てのエントリがtsより古い場合はエントリの数を返す。
+func (t *timeIndex) Search(ts int64) int64 {
+	n := int(t.size / timeEntWidth)
+	return int64(sort.Search(n, func(i int) bool {
+		return int64(enc.Uint64(t.mmap[uint64(i)*timeEntWidth:])) >= ts
+	}))
+}
+
+// エントリを追加する。タイムスタンプが最後のエントリより新しくない場合と、タイムスタンプを持たないレコードの場合は何もしない。
+func (t *timeIndex) Write(ts int64, off uint32) error {
+	var last int64
+	if l, _, err := t.Read(-1); err == nil {
+		last = l
+	}
+	if ts <= last {
+		return nil
+	}
+	if uint64(len(t.mmap)) < t.size+timeEntWidth {
+		return io.EOF
+	}
+	enc.PutUint64(t.mmap[t.size:t.size+tsWidth], uint64(ts))
+	enc.PutUint32(t.mmap[t.size+tsWidth:t.size+timeEntWidth], off)
+	t.size += timeEntWidth
+	return nil
+}
+
+// 相対オフセットがoff以上のエントリを捨てる。エントリの相対オフセットも昇順に並んでいる。
+func (t *timeIndex) truncate(off uint32) {
+	n := int(t.size / timeEntWidth)
+	j := sort.Search(n, func(j int) bool {
+		return enc.Uint32(t.mmap[uint64(j)*timeEntWidth+tsWidth:]) >= off
+	})
+	t.size = uint64(j) * timeEntWidth
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
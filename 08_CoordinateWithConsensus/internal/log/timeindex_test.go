@@ -0,0 +1,54 @@
+package log
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+
+	_, _, err = idx.Read(-1)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(0), idx.Search(100))
+
+	// タイムスタンプを持たないレコードと、最後のエントリより新しくないレコードは記録しない
+	require.NoError(t, idx.Write(0, 0))
+	require.NoError(t, idx.Write(100, 1))
+	require.NoError(t, idx.Write(100, 2))
+	require.NoError(t, idx.Write(90, 3))
+	require.NoError(t, idx.Write(200, 4))
+	require.Equal(t, 2*timeEntWidth, idx.size)
+
+	ts, off, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), ts)
+	require.Equal(t, uint32(4), off)
+
+	require.Equal(t, int64(0), idx.Search(50))
+	require.Equal(t, int64(0), idx.Search(100))
+	require.Equal(t, int64(1), idx.Search(101))
+	require.Equal(t, int64(2), idx.Search(201))
+	require.NoError(t, idx.Close())
+
+	// 閉じた後も既存のファイルから状態を構築する
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+	ts, off, err = idx.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), ts)
+	require.Equal(t, uint32(1), off)
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,250 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	api "github.com/lottotto/proglog/api/v1"
+)
+
+var topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// 名前付きトピックのログを管理する。トピックはdir以下のディレクトリを持ち、その下にパーティションごとのセグメントのディレクトリを持つ。
+// 作成と削除はraftのエントリを適用したFSMからのみ行う。
+type topics struct {
+	mu     sync.RWMutex
+	dir    string
+	config Config
+	// パーティション番号の順に並んだログ
+	logs map[string][]*Log
+}
+
+// dirにすでに存在するトピックを開く。
+func newTopics(dir string, c Config) (*topics, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t := &topics{
+		dir:    dir,
+		config: c,
+		logs:   make(map[string][]*Log),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		logs, err := t.openPartitions(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		t.logs[entry.Name()] = logs
+	}
+	return t, nil
+}
+
+// トピックのディレクトリにあるパーティションを番号順に開く。パーティションは0から連番で作られる
+func (t *topics) openPartitions(name string) ([]*Log, error) {
+	entries, err := os.ReadDir(filepath.Join(t.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var logs []*Log
+	for {
+		partition := uint32(len(logs))
+		dir := t.partitionDir(name, partition)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		l, err := NewLog(dir, t.config)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	if len(logs) != len(entries) {
+		return nil, fmt.Errorf("topic %s has non-contiguous partitions", name)
+	}
+	return logs, nil
+}
+
+func (t *topics) partitionDir(name string, partition uint32) string {
+	return filepath.Join(t.dir, name, strconv.FormatUint(uint64(partition), 10))
+}
+
+func validateTopicName(name string) error {
+	if !topicNamePattern.MatchString(name) || name == "." || name == ".." {
+		return api.ErrInvalidTopicName{Topic: name}
+	}
+	return nil
+}
+
+func (t *topics) get(name string, partition uint32) (*Log, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	logs, ok := t.logs[name]
+	if !ok {
+		return nil, api.ErrUnknownTopic{Topic: name}
+	}
+	if partition >= uint32(len(logs)) {
+		return nil, api.ErrUnknownPartition{Topic: name, Partition: partition}
+	}
+	return logs[partition], nil
+}
+
+func (t *topics) partitions(name string) (uint32, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	logs, ok := t.logs[name]
+	if !ok {
+		return 0, api.ErrUnknownTopic{Topic: name}
+	}
+	return uint32(len(logs)), nil
+}
+
+// partitionsが0の場合は1つのパーティションを持つトピックを作る。
+func (t *topics) create(name string, partitions uint32) error {
+	if err := validateTopicName(name); err != nil {
+		return err
+	}
+	if partitions == 0 {
+		partitions = 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.logs[name]; ok {
+		return api.ErrTopicExists{Topic: name}
+	}
+	logs := make([]*Log, 0, partitions)
+	for i := uint32(0); i < partitions; i++ {
+		dir := t.partitionDir(name, i)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		l, err := NewLog(dir, t.config)
+		if err != nil {
+			return err
+		}
+		logs = append(logs, l)
+	}
+	t.logs[name] = logs
+	return nil
+}
+
+func (t *topics) delete(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	logs, ok := t.logs[name]
+	if !ok {
+		return api.ErrUnknownTopic{Topic: name}
+	}
+	delete(t.logs, name)
+	for _, l := range logs {
+		if err := l.Remove(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(t.dir, name))
+}
+
+// トピック名を昇順で返す。
+func (t *topics) list() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.logs))
+	for name := range t.logs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 全てのトピックを削除する。スナップショットから復元する前に使う。
+func (t *topics) reset() error {
+	for _, name := range t.list() {
+		if err := t.delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, logs := range t.logs {
+		for _, l := range logs {
+			if err := l.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 名前付きトピックの1つのパーティションのログ。DistributedLogと同じく、書き込みはraftを経由し、読み出しはローカルのログから行う。
+// パーティションごとにraftグループを持たないので、パーティションは書き込みの順序をキーごとに分けるだけで、書き込みを分散しない。
+type Topic struct {
+	name      string
+	partition uint32
+	dlog      *DistributedLog
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+func (t *Topic) Partition() uint32 {
+	return t.partition
+}
+
+func (t *Topic) Append(record *api.Record) (uint64, error) {
+	return t.dlog.append(t.name, t.partition, record)
+}
+
+func (t *Topic) AppendBatch(records []*api.Record) ([]uint64, error) {
+	return t.dlog.appendBatch(t.name, t.partition, records)
+}
+
+func (t *Topic) Read(offset uint64) (*api.Record, error) {
+	l, err := t.dlog.topics.get(t.name, t.partition)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(offset)
+}
+
+func (t *Topic) OffsetForTime(ts int64) (uint64, error) {
+	l, err := t.dlog.topics.get(t.name, t.partition)
+	if err != nil {
+		return 0, err
+	}
+	return l.OffsetForTime(ts)
+}
+
+func (t *Topic) LowerOffset() (uint64, error) {
+	l, err := t.dlog.topics.get(t.name, t.partition)
+	if err != nil {
+		return 0, err
+	}
+	return l.LowerOffset()
+}
+
+// トピックが削除されていた場合は閉じたチャネルを返し、待っている読み出し側がReadでエラーを受け取れるようにする。
+func (t *Topic) Appended() <-chan struct{} {
+	l, err := t.dlog.topics.get(t.name, t.partition)
+	if err != nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return l.Appended()
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"hash/fnv"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -17,19 +18,27 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	CommitLog       CommitLog
+	Authorizer      Authorizer
+	OffsetStore     OffsetStore
+	Topics          TopicManager
+	ReadBarrier     ReadBarrier
+	Forwarder       Forwarder
+	ServerRetriever ServerRetriever
+	ClusterManager  ClusterManager
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	manageAction   = "manage"
 )
 
 // TODO: ここの記載方法を調べる
@@ -41,7 +50,53 @@ type grpcServer struct {
 }
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
 	Read(uint64) (*api.Record, error)
+	Appended() <-chan struct{}
+	// タイムスタンプ(UnixNano)以降に追加された最初のレコードのオフセットを返す
+	OffsetForTime(int64) (uint64, error)
+	// 保持している最も古いオフセットを返す
+	LowerOffset() (uint64, error)
+}
+
+// コンシューマグループのオフセットをトピックのパーティションごとに保存する。指定されていない場合、コンシューマグループのRPCはUnimplementedを返す
+type OffsetStore interface {
+	CommitOffset(topic string, partition uint32, group string, offset uint64) error
+	FetchOffset(topic string, partition uint32, group string) (uint64, error)
+}
+
+// 名前付きトピックを管理する。指定されていない場合、トピックのRPCはUnimplementedを返し、デフォルトのトピックのみ使える
+type TopicManager interface {
+	CreateTopic(name string, partitions uint32) error
+	DeleteTopic(name string) error
+	ListTopics() ([]string, error)
+	Partitions(name string) (uint32, error)
+	Topic(name string, partition uint32) (CommitLog, error)
+}
+
+// LOCAL以外の一貫性での読み出しに使う。指定されていない場合、LOCAL以外の読み出しはUnimplementedを返す
+// フォロワーはLINEARIZABLEの読み出しで、Forwarderがあればリーダーから得たReadIndexのインデックスまで適用されるのをWaitAppliedで待つ
+type ReadBarrier interface {
+	ReadBarrier(level api.Consistency) error
+	ReadIndex() (uint64, error)
+	WaitApplied(index uint64) error
+}
+
+// フォロワーが受け取った書き込みをリーダーに転送する。指定されていない場合、フォロワーはリーダーのアドレスを含めたErrNotLeaderを返す
+type Forwarder interface {
+	LeaderClient() (api.LogClient, error)
+}
+
+// クライアントがクラスタのサーバを発見するために使う。指定されていない場合、GetServersはUnimplementedを返す
+type ServerRetriever interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// 運用者がサーバをクラスタに追加、削除し、投票権を変更するために使う。指定されていない場合、Join、Leave、SetVoterはUnimplementedを返す
+type ClusterManager interface {
+	Join(id, addr string, voter bool) error
+	Leave(id string) error
+	SetVoter(id string, voter bool) error
 }
 
 type Authorizer interface {
@@ -101,17 +156,85 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	// 認可処理
 	if err := s.Authorizer.Authorize(
 		subject(ctx), // ここなに
-		objectWildcard,
+		object(req.Topic),
 		produceAction,
 	); err != nil {
 		return nil, err
 	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	partition, err := s.partition(req.Topic, req.Partition, req.Record)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	clog, err := s.commitLog(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.Append(req.Record)
+	if err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.Produce(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
+}
+
+// 複数のレコードを1回の認可と、パーティションごとに1回の書き込みでまとめて追加する
+// パーティションをまたぐバッチはパーティションごとに書き込むので、途中でエラーが返った場合は一部のパーティションにのみ追加されている可能性がある
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+
+	// 認可処理
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+
+	// パーティションごとにレコードをまとめる。パーティション内の順序はリクエストの順序を保つ
+	partitions := make([]uint32, len(req.Records))
+	batches := make(map[uint32][]int)
+	var order []uint32
+	for i, record := range req.Records {
+		partition, err := s.partition(req.Topic, req.Partition, record)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := batches[partition]; !ok {
+			order = append(order, partition)
+		}
+		partitions[i] = partition
+		batches[partition] = append(batches[partition], i)
+	}
+
+	offsets := make([]uint64, len(req.Records))
+	for n, partition := range order {
+		clog, err := s.commitLog(req.Topic, partition)
+		if err != nil {
+			return nil, err
+		}
+		idx := batches[partition]
+		records := make([]*api.Record, len(idx))
+		for j, i := range idx {
+			records[j] = req.Records[i]
+		}
+		offs, err := clog.AppendBatch(records)
+		if err != nil {
+			// 既に書き込んだパーティションを重複させないように、最初のパーティションの書き込みに失敗した場合のみ転送する
+			if n == 0 {
+				if leader, ctx, ok := s.forward(ctx, err); ok {
+					return leader.ProduceBatch(ctx, req)
+				}
+			}
+			return nil, err
+		}
+		for j, i := range idx {
+			offsets[i] = offs[j]
+		}
+	}
+	return &api.ProduceBatchResponse{Offsets: offsets, Partitions: partitions}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
@@ -119,19 +242,344 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	// 認可処理
 	if err := s.Authorizer.Authorize(
 		subject(ctx), // ここなに
-		objectWildcard,
-		produceAction,
+		object(req.Topic),
+		consumeAction,
 	); err != nil {
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := s.readBarrier(ctx, req.Consistency); err != nil {
+		return nil, err
+	}
+
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset := req.Offset
+	if req.StartTime != 0 {
+		if offset, err = clog.OffsetForTime(req.StartTime); err != nil {
+			return nil, err
+		}
+	}
+	record, err := clog.Read(offset)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *api.OffsetForTimeRequest) (*api.OffsetForTimeResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.OffsetForTime(req.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &api.OffsetForTimeResponse{Offset: offset}, nil
+}
+
+// フォロワーがLINEARIZABLEで読み出すために、リーダーであることを確認してFSMに適用済みのインデックスを返す
+func (s *grpcServer) ReadIndex(ctx context.Context, req *api.ReadIndexRequest) (*api.ReadIndexResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.ReadBarrier == nil {
+		return nil, status.Error(codes.Unimplemented, "consistency levels other than local are not supported")
+	}
+	index, err := s.ReadBarrier.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ReadIndexResponse{Index: index}, nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.OffsetStore == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups are not supported")
+	}
+	if req.Group == "" {
+		return nil, api.ErrInvalidGroupName{Group: req.Group}
+	}
+
+	if err := s.OffsetStore.CommitOffset(req.Topic, req.Partition, req.Group, req.Offset); err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.CommitOffset(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Topic),
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.OffsetStore == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups are not supported")
+	}
+
+	offset, err := s.OffsetStore.FetchOffset(req.Topic, req.Partition, req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Name),
+		manageAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+
+	if err := s.Topics.CreateTopic(req.Name, req.Partitions); err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.CreateTopic(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		object(req.Name),
+		manageAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+
+	if err := s.Topics.DeleteTopic(req.Name); err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.DeleteTopic(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+
+	topics, err := s.Topics.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	partitions := make(map[string]uint32, len(topics))
+	for _, topic := range topics {
+		n, err := s.Topics.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		partitions[topic] = n
+	}
+	return &api.ListTopicsResponse{Topics: topics, Partitions: partitions}, nil
+}
+
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.ServerRetriever == nil {
+		return nil, status.Error(codes.Unimplemented, "server discovery is not supported")
+	}
+
+	servers, err := s.ServerRetriever.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+func (s *grpcServer) Join(ctx context.Context, req *api.JoinRequest) (*api.JoinResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.ClusterManager == nil {
+		return nil, status.Error(codes.Unimplemented, "cluster management is not supported")
+	}
+
+	if err := s.ClusterManager.Join(req.Id, req.RpcAddr, !req.NonVoter); err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.Join(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.JoinResponse{}, nil
+}
+
+func (s *grpcServer) Leave(ctx context.Context, req *api.LeaveRequest) (*api.LeaveResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.ClusterManager == nil {
+		return nil, status.Error(codes.Unimplemented, "cluster management is not supported")
+	}
+
+	if err := s.ClusterManager.Leave(req.Id); err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.Leave(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.LeaveResponse{}, nil
+}
+
+func (s *grpcServer) SetVoter(ctx context.Context, req *api.SetVoterRequest) (*api.SetVoterResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		manageAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.ClusterManager == nil {
+		return nil, status.Error(codes.Unimplemented, "cluster management is not supported")
+	}
+
+	if err := s.ClusterManager.SetVoter(req.Id, req.Voter); err != nil {
+		if leader, ctx, ok := s.forward(ctx, err); ok {
+			return leader.SetVoter(ctx, req)
+		}
+		return nil, err
+	}
+	return &api.SetVoterResponse{}, nil
+}
+
+// 転送されたリクエストであることを示すメタデータのキー。転送先もリーダーでなかった場合に、さらに転送しないようにする
+const forwardedKey = "proglog-forwarded"
+
+// errがErrNotLeaderで転送できる場合に、リーダーのクライアントと転送に使うコンテキストを返す。
+// 転送先では転送元のサーバの証明書で認可されるので、転送元で認可してから呼び出す
+func (s *grpcServer) forward(ctx context.Context, err error) (api.LogClient, context.Context, bool) {
+	if _, ok := err.(api.ErrNotLeader); !ok || s.Forwarder == nil {
+		return nil, nil, false
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedKey)) > 0 {
+		return nil, nil, false
+	}
+	leader, err := s.Forwarder.LeaderClient()
+	if err != nil {
+		return nil, nil, false
+	}
+	return leader, metadata.AppendToOutgoingContext(ctx, forwardedKey, "true"), true
+}
+
+// 指定された一貫性で読み出せるようになるまで待つ。
+// フォロワーのLINEARIZABLEの読み出しは、リーダーに問い合わせたインデックスまでローカルに適用されるのを待ってから読み出す(read index)
+func (s *grpcServer) readBarrier(ctx context.Context, level api.Consistency) error {
+	if level == api.Consistency_LOCAL {
+		return nil
+	}
+	if s.ReadBarrier == nil {
+		return status.Error(codes.Unimplemented, "consistency levels other than local are not supported")
+	}
+	err := s.ReadBarrier.ReadBarrier(level)
+	if err == nil || level != api.Consistency_LINEARIZABLE {
+		return err
+	}
+	leader, ctx, ok := s.forward(ctx, err)
+	if !ok {
+		return err
+	}
+	res, err := leader.ReadIndex(ctx, &api.ReadIndexRequest{})
+	if err != nil {
+		return err
+	}
+	return s.ReadBarrier.WaitApplied(res.Index)
+}
+
+// トピック名とパーティションに対応するログを返す。空の場合はデフォルトのトピックのログで、パーティションは0のみ
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, api.ErrUnknownPartition{Topic: topic, Partition: partition}
+		}
+		return s.CommitLog, nil
+	}
+	if s.Topics == nil {
+		return nil, api.ErrUnknownTopic{Topic: topic}
+	}
+	return s.Topics.Topic(topic, partition)
+}
+
+// レコードを書き込むパーティションを決める。キーを持つレコードはキーのハッシュで決め、同じキーのレコードが同じパーティションに順に並ぶようにする。
+// キーを持たないレコードはリクエストで指定されたパーティションに書き込む
+func (s *grpcServer) partition(topic string, partition uint32, record *api.Record) (uint32, error) {
+	if record == nil || len(record.Key) == 0 {
+		return partition, nil
+	}
+	if topic == "" || s.Topics == nil {
+		return 0, nil
+	}
+	n, err := s.Topics.Partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+	return partitionForKey(record.Key, n), nil
+}
+
+func partitionForKey(key []byte, partitions uint32) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % partitions
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -148,15 +596,63 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	// 一貫性は読み出し始める前に1度だけ確認し、以降はコミットされたオフセットもログもローカルから読み出す
+	if err := s.readBarrier(stream.Context(), req.Consistency); err != nil {
+		return err
+	}
+	req.Consistency = api.Consistency_LOCAL
+	// グループが指定されていれば、コミットされたオフセットから再開する。まだコミットがなければreq.Offsetかreq.StartTimeから読み出す
+	if req.Group != "" {
+		res, err := s.FetchOffset(stream.Context(), &api.FetchOffsetRequest{
+			Topic:     req.Topic,
+			Partition: req.Partition,
+			Group:     req.Group,
+		})
+		switch err.(type) {
+		case nil:
+			req.Offset = res.Offset
+			req.StartTime = 0
+		case api.ErrUnknownGroup:
+		default:
+			return err
+		}
+	}
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	// 開始時刻は最初に1度だけオフセットに変換し、以降はオフセットを進めて読み出す
+	if req.StartTime != 0 {
+		if req.Offset, err = clog.OffsetForTime(req.StartTime); err != nil {
+			return err
+		}
+		req.StartTime = 0
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
+			// 読み出す前に取得しておき、読み出してから待つまでの間の追加を取りこぼさないようにする
+			appended := clog.Appended()
 			res, err := s.Consume(stream.Context(), req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// 保持条件や切り詰めで削除されたオフセットは待っても追加されない
+				lowest, lerr := clog.LowerOffset()
+				if lerr != nil {
+					return lerr
+				}
+				if req.Offset < lowest {
+					return err
+				}
+				// ログの末尾に達したら、新しいレコードが追加されるかストリームが閉じられるまで待つ
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-appended:
+				}
 				continue
 			default:
 				return err
@@ -191,3 +687,11 @@ func subject(ctx context.Context) string {
 }
 
 type subjectContextKey struct{}
+
+// 認可の対象となるオブジェクト。デフォルトのトピックはワイルドカードで認可する
+func object(topic string) string {
+	if topic == "" {
+		return objectWildcard
+	}
+	return topic
+}
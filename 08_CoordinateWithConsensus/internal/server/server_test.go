@@ -3,8 +3,11 @@ package server
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,10 +18,12 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	"go.uber.org/zap"
 )
@@ -42,8 +47,20 @@ func TestServer(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, rootClient api.LogClient, nobodyClient api.LogClient, config *Config){
 		"produce/consume a message to/from the log succeeeds": testProduceConsueme,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
+		"produce batch succeeds":                              testProduceBatch,
+		"consume stream waits for new records":                testConsumeStreamWaits,
+		"consume stream below the lowest offset fails":        testConsumeStreamBelowLowest,
+		"consume stream resumes from group offset":            testConsumerGroup,
+		"consume from a start time":                           testConsumeStartTime,
+		"records carry key and headers":                       testKeyAndHeaders,
+		"produce/consume to/from a named topic succeeds":      testTopics,
+		"produce routes records by key to partitions":         testPartitions,
+		"consume with consistency level":                      testConsistency,
+		"get servers returns the cluster":                     testGetServers,
+		"join/leave manage the cluster":                       testJoinLeave,
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"unauthorized fails":                                  testUnauthorized,
+		"consume permission allows reads only":                testConsumeOnly,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -117,6 +134,9 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
+	topicDir, err := os.MkdirTemp("", "server-test-topics")
+	require.NoError(t, err)
+
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 
 	// telemetryの追加
@@ -141,8 +161,10 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	}
 
 	cfg = &Config{
-		CommitLog:  clog,
-		Authorizer: authorizer,
+		CommitLog:   clog,
+		Authorizer:  authorizer,
+		OffsetStore: &offsetStore{offsets: make(map[string]uint64)},
+		Topics:      &topicManager{dir: topicDir, logs: make(map[string][]*log.Log)},
 	}
 	if fn != nil {
 		fn(cfg)
@@ -249,15 +271,553 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// タイムスタンプは追加した時刻が付与される
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 
 	}
 }
 
+func testProduceBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, produce.Offsets)
+
+	for i, off := range produce.Offsets {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, consume.Record.Value)
+	}
+}
+
+func testConsumeStreamWaits(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// ログが空の状態でストリームを開き、末尾で待たせる
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	want := []byte("hello world")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: want},
+		})
+	}()
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, want, res.Record.Value)
+	require.Equal(t, uint64(0), res.Record.Offset)
+}
+
+func testConsumeStreamBelowLowest(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, config.CommitLog.(*log.Log).Truncate(1))
+
+	// 削除されたオフセットは追加されることがないので、待たずにエラーを返す
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	got := status.Code(err)
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+}
+
+func testConsumerGroup(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.Equal(t, status.Code(api.ErrUnknownGroup{}.GRPCStatus().Err()), status.Code(err))
+
+	// 空のグループ名はコミットできない
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "", Offset: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "group", Offset: 1})
+	require.NoError(t, err)
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), fetch.Offset)
+
+	// コミットされたオフセットがリクエストのオフセットより優先される
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0, Group: "group"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, records[1].Value, res.Record.Value)
+	require.Equal(t, uint64(1), res.Record.Offset)
+}
+
+func testConsumeStartTime(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// ログはタイムスタンプを持つレコードをそのまま書き込むので、10, 20, 30の時刻に追加されたことにする
+	records := []*api.Record{
+		{Value: []byte("first message"), Timestamp: 10},
+		{Value: []byte("second message"), Timestamp: 20},
+		{Value: []byte("third message"), Timestamp: 30},
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{Timestamp: 15})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+	// 全てのレコードより新しい時刻は次に追加されるオフセットになる
+	res, err = client.OffsetForTime(ctx, &api.OffsetForTimeRequest{Timestamp: 31})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+
+	// 開始時刻はオフセットより優先される
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, StartTime: 15})
+	require.NoError(t, err)
+	require.Equal(t, records[1].Value, consume.Record.Value)
+	require.Equal(t, int64(20), consume.Record.Timestamp)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{StartTime: 20})
+	require.NoError(t, err)
+	for _, want := range records[1:] {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want.Value, res.Record.Value)
+	}
+}
+
+func testKeyAndHeaders(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	want := &api.Record{
+		Value: []byte("hello world"),
+		Key:   []byte("user-1"),
+		Headers: map[string][]byte{
+			"trace-id":  []byte("abc"),
+			"schema-id": []byte("7"),
+		},
+	}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{want}})
+	require.NoError(t, err)
+
+	for _, off := range []uint64{produce.Offset, batch.Offsets[0]} {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, want.Key, consume.Record.Key)
+		require.Equal(t, want.Headers, consume.Record.Headers)
+	}
+}
+
+type offsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+func (o *offsetStore) CommitOffset(topic string, partition uint32, group string, offset uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.offsets[fmt.Sprintf("%s/%d/%s", topic, partition, group)] = offset
+	return nil
+}
+
+func (o *offsetStore) FetchOffset(topic string, partition uint32, group string) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	off, ok := o.offsets[fmt.Sprintf("%s/%d/%s", topic, partition, group)]
+	if !ok {
+		return 0, api.ErrUnknownGroup{Group: group}
+	}
+	return off, nil
+}
+
+func testTopics(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, list.Topics)
+	require.Equal(t, map[string]uint32{"orders": 1}, list.Partitions)
+
+	want := &api.Record{Value: []byte("order")}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want, Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	// デフォルトのトピックとは別のログになる
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: want, Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testPartitions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "users", Partitions: 4})
+	require.NoError(t, err)
+
+	// 同じキーのレコードは同じパーティションに順に書き込まれる
+	records := []*api.Record{
+		{Value: []byte("alice first"), Key: []byte("alice")},
+		{Value: []byte("bob first"), Key: []byte("bob")},
+		{Value: []byte("alice second"), Key: []byte("alice")},
+	}
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records, Topic: "users"})
+	require.NoError(t, err)
+	require.Len(t, batch.Partitions, len(records))
+	require.Equal(t, batch.Partitions[0], batch.Partitions[2])
+	require.Equal(t, batch.Offsets[0]+1, batch.Offsets[2])
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("alice third"), Key: []byte("alice")},
+		Topic:  "users",
+	})
+	require.NoError(t, err)
+	require.Equal(t, batch.Partitions[0], produce.Partition)
+	require.Equal(t, batch.Offsets[2]+1, produce.Offset)
+
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Topic:     "users",
+			Partition: batch.Partitions[i],
+			Offset:    batch.Offsets[i],
+		})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+
+	// キーを持たないレコードは指定されたパーティションに書き込まれる
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("no key")},
+		Topic:     "users",
+		Partition: 3,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), produce.Partition)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "users", Partition: 4})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testConsistency(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	want := &api.Record{Value: []byte("hello world")}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+
+	// ReadBarrierがない場合はLOCALのみ読み出せる
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_LEADER,
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	barrier := &readBarrier{leader: "127.0.0.1:8400", index: 7}
+	config.ReadBarrier = barrier
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_LEADER,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+
+	// リーダーでない場合はリーダーのアドレスを詳細に含めて返す
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_LINEARIZABLE,
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	var leader string
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			leader = info.Metadata["leader"]
+		}
+	}
+	require.Equal(t, "127.0.0.1:8400", leader)
+
+	// 転送できる場合は、リーダーのReadIndexで得たインデックスまで適用されるのを待ってから読み出す
+	config.Forwarder = forwarder{client: client}
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_LINEARIZABLE,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, []uint64{7}, barrier.waited)
+}
+
+func testGetServers(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	want := []*api.Server{
+		{Id: "0", RpcAddr: "127.0.0.1:8400", IsLeader: true, IsVoter: true},
+		{Id: "1", RpcAddr: "127.0.0.1:8401", IsVoter: true},
+	}
+	config.ServerRetriever = serverRetriever(want)
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, len(want))
+	for i, server := range res.Servers {
+		require.True(t, proto.Equal(want[i], server))
+	}
+}
+
+func testJoinLeave(t *testing.T, client, nobody api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.Join(ctx, &api.JoinRequest{Id: "1", RpcAddr: "127.0.0.1:8401"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.SetVoter(ctx, &api.SetVoterRequest{Id: "1", Voter: true})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	cluster := clusterManager{}
+	config.ClusterManager = cluster
+	_, err = client.Join(ctx, &api.JoinRequest{Id: "1", RpcAddr: "127.0.0.1:8401"})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(&api.Server{Id: "1", RpcAddr: "127.0.0.1:8401", IsVoter: true}, cluster["1"]))
+
+	// 読み出し専用のレプリカとして参加させ、後から昇格させる
+	_, err = client.Join(ctx, &api.JoinRequest{Id: "2", RpcAddr: "127.0.0.1:8402", NonVoter: true})
+	require.NoError(t, err)
+	require.False(t, cluster["2"].IsVoter)
+	_, err = client.SetVoter(ctx, &api.SetVoterRequest{Id: "2", Voter: true})
+	require.NoError(t, err)
+	require.True(t, cluster["2"].IsVoter)
+	_, err = client.SetVoter(ctx, &api.SetVoterRequest{Id: "3", Voter: true})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.Leave(ctx, &api.LeaveRequest{Id: "1"})
+	require.NoError(t, err)
+	_, err = client.Leave(ctx, &api.LeaveRequest{Id: "2"})
+	require.NoError(t, err)
+	require.Empty(t, cluster)
+
+	_, err = nobody.Join(ctx, &api.JoinRequest{Id: "2", RpcAddr: "127.0.0.1:8402"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.SetVoter(ctx, &api.SetVoterRequest{Id: "2", Voter: false})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+type clusterManager map[string]*api.Server
+
+func (c clusterManager) Join(id, addr string, voter bool) error {
+	c[id] = &api.Server{Id: id, RpcAddr: addr, IsVoter: voter}
+	return nil
+}
+
+func (c clusterManager) Leave(id string) error {
+	delete(c, id)
+	return nil
+}
+
+func (c clusterManager) SetVoter(id string, voter bool) error {
+	server, ok := c[id]
+	if !ok {
+		return api.ErrUnknownServer{ID: id}
+	}
+	server.IsVoter = voter
+	return nil
+}
+
+type serverRetriever []*api.Server
+
+func (s serverRetriever) GetServers() ([]*api.Server, error) {
+	return s, nil
+}
+
+// LEADERまでのみ読み出せるサーバとして振る舞う。ReadIndexはindexを返し、WaitAppliedで待ったインデックスを記録する
+type readBarrier struct {
+	leader string
+	index  uint64
+	waited []uint64
+}
+
+func (r *readBarrier) ReadBarrier(level api.Consistency) error {
+	if level == api.Consistency_LINEARIZABLE {
+		return api.ErrNotLeader{Leader: r.leader}
+	}
+	return nil
+}
+
+func (r *readBarrier) ReadIndex() (uint64, error) {
+	return r.index, nil
+}
+
+func (r *readBarrier) WaitApplied(index uint64) error {
+	r.waited = append(r.waited, index)
+	return nil
+}
+
+// 自身をリーダーとして転送する
+type forwarder struct {
+	client api.LogClient
+}
+
+func (f forwarder) LeaderClient() (api.LogClient, error) {
+	return f.client, nil
+}
+
+type topicManager struct {
+	mu   sync.Mutex
+	dir  string
+	logs map[string][]*log.Log
+}
+
+func (m *topicManager) CreateTopic(name string, partitions uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.logs[name]; ok {
+		return api.ErrTopicExists{Topic: name}
+	}
+	if partitions == 0 {
+		partitions = 1
+	}
+	for i := uint32(0); i < partitions; i++ {
+		dir := filepath.Join(m.dir, name, fmt.Sprint(i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		l, err := log.NewLog(dir, log.Config{})
+		if err != nil {
+			return err
+		}
+		m.logs[name] = append(m.logs[name], l)
+	}
+	return nil
+}
+
+func (m *topicManager) DeleteTopic(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs, ok := m.logs[name]
+	if !ok {
+		return api.ErrUnknownTopic{Topic: name}
+	}
+	delete(m.logs, name)
+	for _, l := range logs {
+		if err := l.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *topicManager) ListTopics() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.logs {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (m *topicManager) Partitions(name string) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs, ok := m.logs[name]
+	if !ok {
+		return 0, api.ErrUnknownTopic{Topic: name}
+	}
+	return uint32(len(logs)), nil
+}
+
+func (m *topicManager) Topic(name string, partition uint32) (CommitLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs, ok := m.logs[name]
+	if !ok {
+		return nil, api.ErrUnknownTopic{Topic: name}
+	}
+	if partition >= uint32(len(logs)) {
+		return nil, api.ErrUnknownPartition{Topic: name, Partition: partition}
+	}
+	return logs[partition], nil
+}
+
+// consumeの権限だけを持つ主体は、読み出しはできるが書き込みはできない
+func testConsumeOnly(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	config.Authorizer = actionAuthorizer{consumeAction: true}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// 指定されたアクションだけを許可する
+type actionAuthorizer map[string]bool
+
+func (a actionAuthorizer) Authorize(subject, object, action string) error {
+	if !a[action] {
+		return status.Errorf(codes.PermissionDenied, "%s not permitted to %s to %s", subject, action, object)
+	}
+	return nil
+}
+
 func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	ctx := context.Background()
 	produce, err := client.Produce(ctx,
@@ -284,4 +844,9 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	if gotCode != wantCode {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
 }